@@ -2,51 +2,351 @@ package blame
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"slices"
+	"strings"
 
 	"github.com/vasilisp/lingograph"
 	"github.com/vasilisp/lingograph/extra"
-	"github.com/vasilisp/lingograph/openai"
-	"github.com/vasilisp/semblame/internal/data"
+	"github.com/vasilisp/lingograph/pkg/slicev"
+	"github.com/vasilisp/lingograph/store"
 	"github.com/vasilisp/semblame/internal/git"
+	"github.com/vasilisp/semblame/internal/openai"
 	"github.com/vasilisp/semblame/internal/shared"
 )
 
-func commitMessages(ctx context.Context, repoPath string, matches []shared.Match) ([]lingograph.Pipeline, error) {
-	result := make([]lingograph.Pipeline, len(matches))
+// ErrNoAPIKey is returned when OPENAI_API_KEY is not set and no other API is
+// configured.
+var ErrNoAPIKey = errors.New("OPENAI_API_KEY environment variable is not set")
 
-	for i, match := range matches {
-		commitContent, err := git.GetCommit(ctx, repoPath, match.CommitHash)
+// echo returns a lingograph echo function writing sanitized messages to w.
+func echo(w io.Writer) func(msg lingograph.Message) {
+	return func(msg lingograph.Message) {
+		extra.SanitizeOutput(msg.Content, false, w)
+		w.Write([]byte{'\n'})
+	}
+}
+
+// Session is a conversation with the LLM about a repository, in which
+// questions may refer to earlier questions, answers and commits.
+type Session struct {
+	repoPath string
+	config   git.ChatConfig
+	search   Searcher
+	prompt   *systemPrompt
+	// history is the conversation so far, replayed before every question
+	history []entry
+	// commits are those already in the conversation
+	commits map[string]bool
+	// budget is the number of tokens the conversation may take up
+	budget int
+}
+
+// entry is a message of the conversation, along with the commit it shows, if
+// any.
+type entry struct {
+	message lingograph.Message
+	commit  string
+	// summarized is set once the message is cut down to the header of commit,
+	// or if it cannot be cut down further
+	summarized bool
+}
+
+// historyCost returns the number of tokens history takes up.
+func historyCost(history []entry) int {
+	cost := 0
+	for _, e := range history {
+		cost += estimateTokens(e.message.Content)
+	}
+
+	return cost
+}
+
+func historyMessages(history []entry) []lingograph.Message {
+	messages := make([]lingograph.Message, len(history))
+	for i, e := range history {
+		messages[i] = e.message
+	}
+
+	return messages
+}
+
+// Options configures a Session.
+type Options struct {
+	// Config selects the chat model.
+	Config git.ChatConfig
+	// Prompt selects the system prompt.
+	Prompt Prompt
+	// Search, if set, lets the model run semantic searches of its own.
+	Search Searcher
+}
+
+// NewSession starts a conversation about the repository at repoPath.
+func NewSession(ctx context.Context, repoPath string, opts Options) (*Session, error) {
+	if opts.Config.BaseURL == "" && os.Getenv("OPENAI_API_KEY") == "" {
+		return nil, ErrNoAPIKey
+	}
+
+	systemPrompt, err := newSystemPrompt(ctx, repoPath, opts.Config, opts.Prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		repoPath: repoPath,
+		config:   opts.Config,
+		search:   opts.Search,
+		prompt:   systemPrompt,
+		commits:  make(map[string]bool),
+		budget:   modelBudget(opts.Config.Model, opts.Config.PromptBudget),
+	}, nil
+}
+
+// Reset forgets the conversation so far.
+func (s *Session) Reset() {
+	s.history = nil
+	s.commits = make(map[string]bool)
+}
+
+// replay returns a pipeline writing messages to the chat as they are.
+func replay(messages []lingograph.Message) lingograph.Pipeline {
+	return lingograph.NewActorUnsafe(lingograph.User, func(slicev.RO[lingograph.Message], store.Store) ([]lingograph.Message, error) {
+		return messages, nil
+	}).Pipeline(nil, false, 1)
+}
+
+func userMessage(content string) lingograph.Message {
+	return lingograph.Message{Role: lingograph.User, Content: content}
+}
+
+// summarizedCommit follows the header of a commit summarized to make room for
+// newer ones.
+const summarizedCommit = "\n    [diff omitted to make room for later commits]\n"
+
+// shownEntries returns entries with texts, those given to commits by
+// fitCommits.
+func shownEntries(commits []shownCommit, texts []string) []entry {
+	entries := make([]entry, len(texts))
+	for i, text := range texts {
+		entries[i] = entry{
+			message:    userMessage(text),
+			commit:     commits[i].hash,
+			summarized: commits[i].missing,
+		}
+	}
+
+	return entries
+}
+
+// compact returns a copy of the conversation in which the oldest commits are
+// cut down to their header until need tokens are left of the budget, or no
+// commit is left to cut down.
+func (s *Session) compact(ctx context.Context, need int) ([]entry, error) {
+	history := slices.Clone(s.history)
+	available := s.budget - historyCost(history)
+
+	for i := range history {
+		if available >= need {
+			break
+		}
+
+		e := &history[i]
+		if e.commit == "" || e.summarized {
+			continue
+		}
+
+		header, err := git.CommitHeader(ctx, s.repoPath, e.commit)
 		if err != nil {
 			return nil, err
 		}
 
-		result[i] = lingograph.UserPrompt(
-			commitContent,
-			false,
-		)
+		content := header + summarizedCommit
+		available += estimateTokens(e.message.Content) - estimateTokens(content)
+		e.message.Content = content
+		e.summarized = true
 	}
 
-	return result, nil
+	return history, nil
 }
 
-func Blame(ctx context.Context, repoPath string, matches []shared.Match, query string) {
-	messages, err := commitMessages(ctx, repoPath, matches)
+// commitEntries returns the conversation so far, with older commits
+// summarized to make room as needed, and entries for the commits of matches
+// not yet in it, fitted in what is left of the budget once query is asked.
+// The conversation is left as is.
+func (s *Session) commitEntries(ctx context.Context, matches []shared.Match, query string) ([]entry, []entry, error) {
+	var fresh []shared.Match
+	for _, match := range matches {
+		if !s.commits[match.CommitHash] && !slices.ContainsFunc(fresh, func(m shared.Match) bool {
+			return m.CommitHash == match.CommitHash
+		}) {
+			fresh = append(fresh, match)
+		}
+	}
+
+	shown, err := showCommits(ctx, s.repoPath, fresh)
 	if err != nil {
-		log.Fatalf("failed to get commit messages: %v", err)
+		return nil, nil, fmt.Errorf("failed to get commit messages: %w", err)
+	}
+
+	// new commits may take up to half the budget before older ones are
+	// summarized for them; the rest stays with the conversation
+	want := 0
+	for _, commit := range shown {
+		want += commit.cost()
 	}
+	want = min(want, s.budget/2) + estimateTokens(query)
 
-	messages = append(messages, lingograph.UserPrompt(query, false))
+	history, err := s.compact(ctx, want)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to summarize commits: %w", err)
+	}
 
-	client := openai.NewClient(openai.APIKeyFromEnv())
-	actor := openai.NewActor(client, openai.GPT41Mini, data.SystemPrompt, nil)
+	budget := s.budget - historyCost(history) - estimateTokens(query)
 
-	messages = append(messages, actor.Pipeline(extra.Echoln(os.Stdout, ""), false, 3))
+	texts, err := fitCommits(ctx, s.repoPath, shown, query, budget)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get commit messages: %w", err)
+	}
 
-	pipeline := lingograph.Chain(messages...)
+	return history, shownEntries(shown, texts), nil
+}
+
+// citedEntries returns entries for the commits of found, full hashes, that
+// answer cites and that are not in conversation, fitted in what is left of
+// the budget.
+func (s *Session) citedEntries(ctx context.Context, conversation []entry, found []string, answer, query string) ([]entry, error) {
+	cited := shared.HashMention.FindAllString(answer, -1)
+
+	var matches []shared.Match
+	for _, commitHash := range found {
+		if s.commits[commitHash] || slices.ContainsFunc(conversation, func(e entry) bool {
+			return e.commit == commitHash
+		}) {
+			continue
+		}
+
+		if slices.ContainsFunc(cited, func(prefix string) bool {
+			return strings.HasPrefix(commitHash, prefix)
+		}) {
+			matches = append(matches, shared.Match{CommitHash: commitHash})
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, nil
+	}
+
+	shown, err := showCommits(ctx, s.repoPath, matches)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cited commits: %w", err)
+	}
+
+	budget := s.budget - historyCost(conversation) - estimateTokens(answer)
+
+	texts, err := fitCommits(ctx, s.repoPath, shown, query, budget)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cited commits: %w", err)
+	}
+
+	return shownEntries(shown, texts), nil
+}
+
+// record makes history, followed by entries, the conversation. The commits
+// of entries become part of it.
+func (s *Session) record(history []entry, entries []entry) {
+	s.history = append(history, entries...)
+
+	for _, e := range entries {
+		if e.commit != "" {
+			s.commits[e.commit] = true
+		}
+	}
+}
+
+// Add puts the matched commits into the conversation, without asking
+// anything. Commits already in it are skipped.
+func (s *Session) Add(ctx context.Context, matches []shared.Match) error {
+	history, entries, err := s.commitEntries(ctx, matches, "")
+	if err != nil {
+		return err
+	}
+
+	s.record(history, entries)
+
+	return nil
+}
+
+// Ask adds the matched commits that are not yet in the conversation and asks
+// query. The commits are shortened as needed to stay within the prompt
+// budget, and older commits summarized to make room for them. Unless
+// disabled, the model may look further into the history with tools (git
+// show, git log -S/-G, git blame and semantic search) before answering, within
+// what is left of the budget; the commits it finds that way and cites join the
+// conversation. The answer is written to w as it arrives, and returned. The
+// question and its commits become part of the conversation only once it is
+// answered.
+func (s *Session) Ask(ctx context.Context, matches []shared.Match, query string, w io.Writer) (string, error) {
+	systemPrompt, err := s.prompt.render(len(matches))
+	if err != nil {
+		return "", err
+	}
+
+	history, entries, err := s.commitEntries(ctx, matches, query)
+	if err != nil {
+		return "", err
+	}
+	entries = append(entries, entry{message: userMessage(query)})
+
+	config := openai.ChatConfig{
+		Model:       s.config.Model,
+		BaseURL:     s.config.BaseURL,
+		Temperature: s.config.Temperature,
+		MaxSteps:    s.config.ToolSteps,
+	}
+	// tool outputs may take up what the conversation leaves of the budget
+	outputs := &toolOutputs{budget: s.budget - historyCost(history) - historyCost(entries)}
+	if config.MaxSteps > 0 {
+		config.Tools = tools(s.repoPath, query, s.search, outputs)
+	}
+
+	actor := openai.NewChatActor(ctx, config, systemPrompt)
 
 	chat := lingograph.NewChat()
+	pipeline := lingograph.Chain(
+		replay(historyMessages(history)),
+		replay(historyMessages(entries)),
+		actor.Pipeline(echo(w), false, 3),
+	)
+
+	if err := pipeline.Execute(chat); err != nil {
+		return "", err
+	}
+
+	answer := chat.History().At(chat.History().Len() - 1)
+
+	// commits found with tools and cited in the answer go before it, as the
+	// model saw them before answering
+	cited, err := s.citedEntries(ctx, append(history, entries...), outputs.commits, answer.Content, query)
+	if err != nil {
+		return "", err
+	}
+	entries = append(entries, cited...)
+
+	s.record(history, append(entries, entry{message: answer}))
+
+	return answer.Content, nil
+}
+
+// Blame asks the chat model to answer query given the matched commits. The
+// answer is written to w as it arrives, and returned.
+func Blame(ctx context.Context, repoPath string, opts Options, matches []shared.Match, query string, w io.Writer) (string, error) {
+	session, err := NewSession(ctx, repoPath, opts)
+	if err != nil {
+		return "", err
+	}
 
-	pipeline.Execute(chat)
+	return session.Ask(ctx, matches, query, w)
 }
@@ -0,0 +1,278 @@
+package blame
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/vasilisp/semblame/internal/git"
+	"github.com/vasilisp/semblame/internal/shared"
+)
+
+// bytesPerToken is the average number of bytes per token assumed when
+// estimating the cost of a prompt. Code and diffs tokenize at roughly four
+// bytes per token with the OpenAI tokenizers.
+const bytesPerToken = 4
+
+func estimateTokens(s string) int {
+	return (len(s) + bytesPerToken - 1) / bytesPerToken
+}
+
+// answerReserve is the number of tokens of the context window kept for the
+// system prompt, the question and the answer.
+const answerReserve = 16384
+
+// contextWindows are the context window sizes, in tokens, of well-known chat
+// models.
+var contextWindows = map[string]int{
+	"gpt-4o":       128000,
+	"gpt-4o-mini":  128000,
+	"gpt-4.1":      1047576,
+	"gpt-4.1-mini": 1047576,
+	"gpt-4.1-nano": 1047576,
+}
+
+// modelBudget caps budget to what fits in the context window of model, if
+// known.
+func modelBudget(model string, budget int) int {
+	if window, ok := contextWindows[model]; ok {
+		return min(budget, window-answerReserve)
+	}
+	return budget
+}
+
+// allocate splits budget among commits costing costs, so that commits
+// costing less than an even share get all they need and the rest share what
+// is left evenly.
+func allocate(costs []int, budget int) []int {
+	order := make([]int, len(costs))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return costs[a] - costs[b] })
+
+	shares := make([]int, len(costs))
+	remaining := max(budget, 0)
+	for i, idx := range order {
+		shares[idx] = min(costs[idx], remaining/(len(order)-i))
+		remaining -= shares[idx]
+	}
+
+	return shares
+}
+
+var queryTerm = regexp.MustCompile(`[\p{L}\p{N}_]{3,}`)
+
+// queryTerms returns the distinct lowercase words of query worth looking for
+// in diffs.
+func queryTerms(query string) []string {
+	var terms []string
+	for _, term := range queryTerm.FindAllString(strings.ToLower(query), -1) {
+		if !slices.Contains(terms, term) {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// hunk is a hunk of a diff, along with the header of the file it belongs to.
+type hunk struct {
+	file  int
+	text  string
+	score int
+}
+
+// splitDiff splits the diff in the output of git show -p into the headers of
+// the changed files and their hunks, in order.
+func splitDiff(show string) ([]string, []hunk) {
+	_, diff, found := strings.Cut(show, "\ndiff --git ")
+	if !found {
+		return nil, nil
+	}
+
+	var headers []string
+	var hunks []hunk
+
+	for i, file := range strings.Split("diff --git "+diff, "\ndiff --git ") {
+		if i > 0 {
+			file = "diff --git " + file
+		}
+
+		parts := strings.Split(file, "\n@@")
+		headers = append(headers, parts[0]+"\n")
+		for _, text := range parts[1:] {
+			hunks = append(hunks, hunk{file: i, text: "@@" + text + "\n"})
+		}
+	}
+
+	return headers, hunks
+}
+
+// cutLines returns the longest prefix of s made of whole lines that fits in
+// about budget tokens.
+func cutLines(s string, budget int) string {
+	n := max(budget, 0) * bytesPerToken
+	if len(s) <= n {
+		return s
+	}
+
+	return s[:strings.LastIndexByte(s[:n], '\n')+1]
+}
+
+// trimCommit shortens show, the output of git show -p, to about budget tokens
+// by keeping the hunks mentioning most words of query after stat, the output
+// of git show --stat. If even stat does not fit, it is cut at a line
+// boundary, but never to less than header (see git.CommitHeader), so that
+// the commit can still be told and cited.
+func trimCommit(show, stat, header, query string, budget int) string {
+	if estimateTokens(stat) >= budget {
+		text := cutLines(stat, budget)
+		if len(text) <= len(header) {
+			text = header
+		}
+		return text + "\n[diff omitted; commit too large]\n"
+	}
+
+	headers, hunks := splitDiff(show)
+
+	terms := queryTerms(query)
+	for i := range hunks {
+		text := strings.ToLower(hunks[i].text)
+		for _, term := range terms {
+			if strings.Contains(text, term) {
+				hunks[i].score++
+			}
+		}
+	}
+
+	byScore := make([]int, len(hunks))
+	for i := range byScore {
+		byScore[i] = i
+	}
+	slices.SortStableFunc(byScore, func(a, b int) int { return hunks[b].score - hunks[a].score })
+
+	remaining := budget - estimateTokens(stat)
+	kept := make([]bool, len(hunks))
+	fileKept := make([]bool, len(headers))
+
+	for _, i := range byScore {
+		cost := estimateTokens(hunks[i].text)
+		if !fileKept[hunks[i].file] {
+			cost += estimateTokens(headers[hunks[i].file])
+		}
+
+		if cost > remaining {
+			continue
+		}
+
+		kept[i] = true
+		fileKept[hunks[i].file] = true
+		remaining -= cost
+	}
+
+	var b strings.Builder
+	b.WriteString(stat)
+
+	omitted := 0
+	file := -1
+	for i, h := range hunks {
+		if !kept[i] {
+			omitted++
+			continue
+		}
+		if h.file != file {
+			b.WriteString(headers[h.file])
+			file = h.file
+		}
+		b.WriteString(h.text)
+	}
+
+	if omitted > 0 {
+		fmt.Fprintf(&b, "\n[%d of %d hunks omitted]\n", omitted, len(hunks))
+	}
+
+	return b.String()
+}
+
+// missingCommit is the text given for indexed commits the repository does
+// not have.
+const missingCommit = "commit %s\n\n    [not in the local repository; its message and diff are unknown]\n"
+
+// shownCommit is a commit as shown by git show -p.
+type shownCommit struct {
+	hash string
+	text string
+	// missing is set for commits the repository does not have, whose text
+	// is missingCommit
+	missing bool
+}
+
+func (c shownCommit) cost() int {
+	return estimateTokens(c.text)
+}
+
+// showCommits returns the commits of matches as shown by git show -p.
+func showCommits(ctx context.Context, repoPath string, matches []shared.Match) ([]shownCommit, error) {
+	hashes := make([]string, len(matches))
+	for i, match := range matches {
+		hashes[i] = match.CommitHash
+	}
+
+	existing, err := git.ExistingCommits(ctx, repoPath, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := make([]shownCommit, len(matches))
+	for i, commitHash := range hashes {
+		if !existing[commitHash] {
+			commits[i] = shownCommit{hash: commitHash, text: fmt.Sprintf(missingCommit, commitHash), missing: true}
+			continue
+		}
+
+		text, err := git.GetCommit(ctx, repoPath, commitHash)
+		if err != nil {
+			return nil, err
+		}
+
+		commits[i] = shownCommit{hash: commitHash, text: text}
+	}
+
+	return commits, nil
+}
+
+// fitCommits returns the texts of commits in about budget tokens overall.
+// Commits are shortened as needed, those costing the most first, to the hunks
+// most relevant to query or to their diffstat, and at worst to their header.
+func fitCommits(ctx context.Context, repoPath string, commits []shownCommit, query string, budget int) ([]string, error) {
+	texts := make([]string, len(commits))
+	costs := make([]int, len(commits))
+	for i, commit := range commits {
+		texts[i] = commit.text
+		costs[i] = commit.cost()
+	}
+
+	shares := allocate(costs, budget)
+
+	for i, commit := range commits {
+		if shares[i] >= costs[i] || commit.missing {
+			continue
+		}
+
+		stat, err := git.CommitStat(ctx, repoPath, commit.hash)
+		if err != nil {
+			return nil, err
+		}
+
+		header, err := git.CommitHeader(ctx, repoPath, commit.hash)
+		if err != nil {
+			return nil, err
+		}
+
+		texts[i] = trimCommit(texts[i], stat, header, query, shares[i])
+	}
+
+	return texts, nil
+}
@@ -0,0 +1,157 @@
+package blame
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vasilisp/semblame/internal/shared"
+)
+
+// testRepo creates a repository with a small commit and a large one, whose
+// diff has a hunk about retries and an unrelated one, and returns its path
+// and the hashes of both commits.
+func testRepo(t *testing.T) (repoPath, small, large string) {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	// isolate git, including the commands under test, from the user's
+	// configuration
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	repoPath = t.TempDir()
+
+	run := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("git", append([]string{"-C", repoPath}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	write := func(name string, lines []string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(repoPath, name), []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commit := func(message string) string {
+		t.Helper()
+		run("add", "-A")
+		run("-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "-q", "-m", message)
+		return run("rev-parse", "HEAD")
+	}
+
+	run("init", "-q")
+
+	lines := make([]string, 200)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i)
+	}
+	write("upload.go", lines)
+	write("README", []string{"uploads"})
+	commit("initial")
+
+	write("README", []string{"uploads, with retries"})
+	small = commit("mention retries")
+
+	lines[10] = "retry the upload after a timeout"
+	for i := 100; i < 190; i++ {
+		lines[i] = fmt.Sprintf("reformatted line %d", i)
+	}
+	write("upload.go", lines)
+	large = commit("retry uploads and reformat")
+
+	return repoPath, small, large
+}
+
+func TestFitCommits(t *testing.T) {
+	ctx := context.Background()
+	repoPath, small, large := testRepo(t)
+
+	commits, err := showCommits(ctx, repoPath, []shared.Match{
+		{CommitHash: small},
+		{CommitHash: large},
+		{CommitHash: strings.Repeat("0", len(small))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for _, commit := range commits {
+		total += commit.cost()
+	}
+
+	t.Run("fits", func(t *testing.T) {
+		texts, err := fitCommits(ctx, repoPath, commits, "retry", total)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, text := range texts {
+			if text != commits[i].text {
+				t.Errorf("commit %d shortened although it fits", i)
+			}
+		}
+	})
+
+	t.Run("relevant hunks", func(t *testing.T) {
+		budget := commits[0].cost() + commits[2].cost() + commits[1].cost()/3
+
+		texts, err := fitCommits(ctx, repoPath, commits, "retry upload", budget)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if texts[0] != commits[0].text || texts[2] != commits[2].text {
+			t.Error("commits within their share were shortened")
+		}
+
+		text := texts[1]
+		if !strings.Contains(text, "retry the upload") {
+			t.Errorf("hunk about the query dropped:\n%s", text)
+		}
+		if strings.Contains(text, "reformatted line") {
+			t.Errorf("unrelated hunk kept:\n%s", text)
+		}
+		if !strings.Contains(text, "[1 of 2 hunks omitted]") {
+			t.Errorf("omission not reported:\n%s", text)
+		}
+
+		cost := 0
+		for _, text := range texts {
+			cost += estimateTokens(text)
+		}
+		if cost > budget {
+			t.Errorf("got %d tokens, budget is %d", cost, budget)
+		}
+	})
+
+	t.Run("headers only", func(t *testing.T) {
+		texts, err := fitCommits(ctx, repoPath, commits, "retry", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, text := range texts[:2] {
+			if !strings.HasPrefix(text, "commit "+commits[i].hash) || !strings.Contains(text, "[diff omitted; commit too large]") {
+				t.Errorf("commit %d not cut to its header:\n%s", i, text)
+			}
+		}
+
+		if texts[2] != commits[2].text {
+			t.Errorf("missing commit changed:\n%s", texts[2])
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package blame
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/vasilisp/semblame/internal/data"
+	"github.com/vasilisp/semblame/internal/git"
+)
+
+// DefaultStyle is the answer style used when none is given.
+const DefaultStyle = "detailed"
+
+// ErrUnknownStyle is returned for answer styles semblame does not have.
+var ErrUnknownStyle = errors.New("unknown answer style")
+
+// Kinds of questions, as seen by system prompt templates.
+const (
+	KindQuery  = "query"
+	KindLines  = "lines"
+	KindSymbol = "symbol"
+	KindChat   = "chat"
+)
+
+// Prompt selects the system prompt for a kind of question.
+type Prompt struct {
+	// Kind is one of KindQuery, KindLines, KindSymbol and KindChat.
+	Kind string
+	// Style is the name of the answer style; DefaultStyle if empty.
+	Style string
+}
+
+// PromptData holds the variables available to system prompt templates.
+type PromptData struct {
+	// Repo is the name of the repository's top directory.
+	Repo string
+	// Kind is the kind of question (see Prompt).
+	Kind string
+	// Commits is the number of commits given with the question.
+	Commits int
+	// Style is the name of the answer style, and Format its instructions on
+	// how to structure the answer.
+	Style  string
+	Format string
+	// Tools is set if the model may call tools.
+	Tools bool
+}
+
+// Styles returns the names of the answer styles.
+func Styles() []string {
+	entries, _ := fs.ReadDir(data.Styles, "styles")
+
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = strings.TrimSuffix(entry.Name(), path.Ext(entry.Name()))
+	}
+
+	return names
+}
+
+// CheckStyle returns ErrUnknownStyle unless style is empty or one of Styles.
+func CheckStyle(style string) error {
+	if style == "" || slices.Contains(Styles(), style) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s (expected one of %s)", ErrUnknownStyle, style, strings.Join(Styles(), ", "))
+}
+
+// systemPrompt is a parsed system prompt template, along with what it is
+// rendered with apart from the number of commits.
+type systemPrompt struct {
+	tmpl *template.Template
+	data PromptData
+}
+
+// newSystemPrompt parses the system prompt template of the repository at
+// repoPath (config.PromptFile, or the default one) for prompt.
+func newSystemPrompt(ctx context.Context, repoPath string, config git.ChatConfig, prompt Prompt) (*systemPrompt, error) {
+	if err := CheckStyle(prompt.Style); err != nil {
+		return nil, err
+	}
+
+	style := prompt.Style
+	if style == "" {
+		style = DefaultStyle
+	}
+
+	format, err := fs.ReadFile(data.Styles, "styles/"+style+".txt")
+	if err != nil {
+		return nil, err
+	}
+
+	text := data.SystemPrompt
+	name := "default prompt"
+	if config.PromptFile != "" {
+		b, err := os.ReadFile(config.PromptFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read prompt file: %w", err)
+		}
+		text = string(b)
+		name = config.PromptFile
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse prompt template: %w", err)
+	}
+
+	top, err := git.TopLevel(ctx, repoPath)
+	if err != nil {
+		return nil, err
+	}
+	if top == "" {
+		if top, err = filepath.Abs(repoPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return &systemPrompt{
+		tmpl: tmpl,
+		data: PromptData{
+			Repo:   strings.TrimSuffix(filepath.Base(top), ".git"),
+			Kind:   prompt.Kind,
+			Style:  style,
+			Format: strings.TrimSpace(string(format)),
+			Tools:  config.ToolSteps > 0,
+		},
+	}, nil
+}
+
+// render returns the system prompt for a question given with commits
+// commits.
+func (p *systemPrompt) render(commits int) (string, error) {
+	data := p.data
+	data.Commits = commits
+
+	var b strings.Builder
+	if err := p.tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render prompt template: %w", err)
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,264 @@
+package blame
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/vasilisp/semblame/internal/git"
+	"github.com/vasilisp/semblame/internal/openai"
+	"github.com/vasilisp/semblame/internal/shared"
+)
+
+// Searcher retrieves up to n indexed commits relevant to query, best first.
+type Searcher func(ctx context.Context, query string, n int) ([]shared.Match, error)
+
+// toolOutputTokens bounds the output of a single tool call.
+const toolOutputTokens = 8000
+
+// errToolBudget is reported to the model once tool outputs have taken up the
+// budget of the question.
+var errToolBudget = errors.New("no room left for tool output; answer with what you have")
+
+// fullHash matches full commit hashes, SHA-1 or SHA-256.
+var fullHash = regexp.MustCompile(`\b(?:[0-9a-f]{64}|[0-9a-f]{40})\b`)
+
+// toolOutputs accounts for the output of the tools called while answering a
+// question.
+type toolOutputs struct {
+	// budget is the number of tokens tool outputs may still take up
+	budget int
+	// commits are the full hashes of the commits mentioned in tool outputs,
+	// in order
+	commits []string
+}
+
+// limit returns the number of tokens the next tool output may take up.
+func (o *toolOutputs) limit() int {
+	return min(toolOutputTokens, o.budget)
+}
+
+// add charges out against the budget and notes the commits it mentions.
+func (o *toolOutputs) add(out string) {
+	o.budget -= estimateTokens(out)
+
+	for _, hash := range fullHash.FindAllString(out, -1) {
+		if !slices.Contains(o.commits, hash) {
+			o.commits = append(o.commits, hash)
+		}
+	}
+}
+
+// pickaxeLimit and searchLimit bound the number of commits a log search or a
+// semantic search returns to the model.
+const (
+	pickaxeLimit = 20
+	searchLimit  = 10
+)
+
+// object returns the JSON schema of an object with the given properties, of
+// which required must be given.
+func object(properties map[string]any, required ...string) map[string]any {
+	return map[string]any{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+func property(typ, description string) map[string]any {
+	return map[string]any{"type": typ, "description": description}
+}
+
+// tool returns an openai.Tool decoding its arguments into a value of type A,
+// whose output is charged to outputs.
+func tool[A any](outputs *toolOutputs, name, description string, parameters map[string]any, call func(context.Context, A) (string, error)) openai.Tool {
+	return openai.Tool{
+		Name:        name,
+		Description: description,
+		Parameters:  parameters,
+		Call: func(ctx context.Context, raw json.RawMessage) (string, error) {
+			if outputs.limit() <= 0 {
+				return "", errToolBudget
+			}
+
+			var args A
+			if err := json.Unmarshal(raw, &args); err != nil {
+				return "", fmt.Errorf("invalid arguments: %w", err)
+			}
+
+			out, err := call(ctx, args)
+			if err != nil {
+				return "", err
+			}
+
+			if limit := outputs.limit(); estimateTokens(out) > limit {
+				cut := cutLines(out, limit)
+				if cut == "" {
+					return "", errToolBudget
+				}
+				out = cut + "\n[output truncated]\n"
+			}
+			outputs.add(out)
+
+			return out, nil
+		},
+	}
+}
+
+// resolveRev returns the commit a revision given by the model names. Revisions
+// starting with a dash are rejected, so that they cannot pass as options to
+// git.
+func resolveRev(ctx context.Context, repoPath, rev string) (string, error) {
+	if strings.HasPrefix(rev, "-") {
+		return "", fmt.Errorf("invalid revision %q", rev)
+	}
+
+	return git.ResolveCommit(ctx, repoPath, rev)
+}
+
+type showArgs struct {
+	Rev string `json:"rev"`
+}
+
+type pickaxeArgs struct {
+	Text   string `json:"text"`
+	Regexp bool   `json:"regexp"`
+	Path   string `json:"path"`
+}
+
+type blameArgs struct {
+	File  string `json:"file"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Rev   string `json:"rev"`
+}
+
+type searchArgs struct {
+	Query string `json:"query"`
+}
+
+// tools returns the tools letting the model dig into the history of the
+// repository at repoPath while answering question, within the budget of
+// outputs. The semantic search tool is left out if search is nil.
+func tools(repoPath, question string, search Searcher, outputs *toolOutputs) []openai.Tool {
+	result := []openai.Tool{
+		tool(outputs, "git_show",
+			"Show the message and diff of a commit (git show -p). Large diffs are cut down to the hunks most relevant to the question.",
+			object(map[string]any{
+				"rev": property("string", "Commit hash or revision, e.g. a1b2c3d or a1b2c3d^"),
+			}, "rev"),
+			func(ctx context.Context, args showArgs) (string, error) {
+				commitHash, err := resolveRev(ctx, repoPath, args.Rev)
+				if err != nil {
+					return "", err
+				}
+
+				show, err := git.GetCommit(ctx, repoPath, commitHash)
+				if err != nil {
+					return "", err
+				}
+
+				limit := outputs.limit()
+				if estimateTokens(show) <= limit {
+					return show, nil
+				}
+
+				stat, err := git.CommitStat(ctx, repoPath, commitHash)
+				if err != nil {
+					return "", err
+				}
+
+				header, err := git.CommitHeader(ctx, repoPath, commitHash)
+				if err != nil {
+					return "", err
+				}
+
+				return trimCommit(show, stat, header, question, limit), nil
+			}),
+		tool(outputs, "git_log_search",
+			fmt.Sprintf("List up to %d commits, newest first, that add or remove a string (git log -S) or, with regexp set, lines matching a regular expression (git log -G).", pickaxeLimit),
+			object(map[string]any{
+				"text":   property("string", "String or regular expression to look for in diffs"),
+				"regexp": property("boolean", "Treat text as a regular expression"),
+				"path":   property("string", "Only look at changes to this path; empty for all"),
+			}, "text", "regexp", "path"),
+			func(ctx context.Context, args pickaxeArgs) (string, error) {
+				out, err := git.Pickaxe(ctx, repoPath, args.Text, args.Regexp, args.Path, pickaxeLimit)
+				if err == nil && out == "" {
+					out = "no commits found"
+				}
+				return out, err
+			}),
+		tool(outputs, "git_blame",
+			"Show which commit last changed each of a range of lines (git blame -w -M -C), with hash, author and date.",
+			object(map[string]any{
+				"file":  property("string", "Path of the file, relative to the top of the repository"),
+				"start": property("integer", "First line, 1-based"),
+				"end":   property("integer", "Last line, inclusive"),
+				"rev":   property("string", "Revision to blame as of, e.g. a1b2c3d^; empty for HEAD"),
+			}, "file", "start", "end", "rev"),
+			func(ctx context.Context, args blameArgs) (string, error) {
+				if args.Start < 1 || args.End < args.Start {
+					return "", fmt.Errorf("invalid line range %d-%d", args.Start, args.End)
+				}
+
+				rev := ""
+				if args.Rev != "" {
+					commitHash, err := resolveRev(ctx, repoPath, args.Rev)
+					if err != nil {
+						return "", err
+					}
+					rev = commitHash
+				}
+
+				return git.BlameText(ctx, repoPath, rev, git.LineRange{File: args.File, Start: args.Start, End: args.End})
+			}),
+	}
+
+	if search == nil {
+		return result
+	}
+
+	return append(result, tool(outputs, "semantic_search",
+		fmt.Sprintf("Find up to %d indexed commits whose message and diff are semantically closest to a natural language query, best first, with their cosine distance.", searchLimit),
+		object(map[string]any{
+			"query": property("string", "What the commits should be about"),
+		}, "query"),
+		func(ctx context.Context, args searchArgs) (string, error) {
+			matches, err := search(ctx, args.Query, searchLimit)
+			if err != nil {
+				return "", err
+			}
+
+			hashes := make([]string, len(matches))
+			for i, match := range matches {
+				hashes[i] = match.CommitHash
+			}
+
+			infos, err := git.CommitInfos(ctx, repoPath, hashes)
+			if err != nil {
+				return "", err
+			}
+
+			var b strings.Builder
+			for _, match := range matches {
+				// commits the repository does not have could not be shown
+				info, ok := infos[match.CommitHash]
+				if !ok {
+					continue
+				}
+				fmt.Fprintf(&b, "%s %.4f %s %s %s\n", match.CommitHash, match.Distance, info.Date.Format("2006-01-02"), info.Author, info.Subject)
+			}
+
+			if b.Len() == 0 {
+				return "no commits found", nil
+			}
+
+			return b.String(), nil
+		}))
+}
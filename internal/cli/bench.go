@@ -0,0 +1,121 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/vasilisp/semblame/internal/db"
+	"github.com/vasilisp/semblame/internal/git"
+	"github.com/vasilisp/semblame/internal/shared"
+	"github.com/vasilisp/semblame/internal/store"
+)
+
+type benchQuery func(dbh *sql.DB, embedding []float64, n int) ([]shared.Match, error)
+
+type latencies []time.Duration
+
+func (l latencies) percentile(p float64) time.Duration {
+	sorted := slices.Clone(l)
+	slices.Sort(sorted)
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+func (l latencies) mean() time.Duration {
+	var total time.Duration
+	for _, d := range l {
+		total += d
+	}
+	return total / time.Duration(len(l))
+}
+
+func queryKNN(dbh *sql.DB, embedding []float64, n int) ([]shared.Match, error) {
+	return db.QueryCommitEmbeddings(dbh, embedding, n, store.Filter{})
+}
+
+func runBenchQuery(dbh *sql.DB, query benchQuery, embedding []float64, k int) ([]shared.Match, time.Duration, error) {
+	start := time.Now()
+	matches, err := query(dbh, embedding, k)
+	return matches, time.Since(start), err
+}
+
+// bench compares the latency of KNN queries on the vec0 table against the
+// brute-force scan, and the recall of the former relative to the latter. The
+// queries are stored commit embeddings sampled evenly across the index, so no
+// embedding requests are made.
+func bench(ctx context.Context, repoPath string, queries, k int) error {
+	config, err := git.NewConfig(ctx, repoPath)
+	if err != nil {
+		return err
+	}
+
+	dbh, err := db.Open(ctx, config.DBPath, config.Model, config.Dimensions)
+	if err != nil {
+		return err
+	}
+	defer dbh.Close()
+
+	var embeddings [][]float64
+	err = db.ForEachCommitEmbedding(dbh, func(_ string, embedding []float64) error {
+		embeddings = append(embeddings, embedding)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(embeddings) == 0 {
+		return fmt.Errorf("index is empty; run ingest first")
+	}
+
+	queries = min(queries, len(embeddings))
+	step := len(embeddings) / queries
+
+	var knnLatencies, bruteLatencies latencies
+	hits, total := 0, 0
+
+	for i := 0; i < queries; i++ {
+		embedding := embeddings[i*step]
+
+		knn, d, err := runBenchQuery(dbh, queryKNN, embedding, k)
+		if err != nil {
+			return err
+		}
+		knnLatencies = append(knnLatencies, d)
+
+		brute, d, err := runBenchQuery(dbh, db.QueryCommitEmbeddingsBruteForce, embedding, k)
+		if err != nil {
+			return err
+		}
+		bruteLatencies = append(bruteLatencies, d)
+
+		found := make(map[string]bool, len(knn))
+		for _, match := range knn {
+			found[match.CommitHash] = true
+		}
+		for _, match := range brute {
+			if found[match.CommitHash] {
+				hits++
+			}
+		}
+		total += len(brute)
+	}
+
+	fmt.Printf("commits:     %d\n", len(embeddings))
+	fmt.Printf("queries:     %d (k=%d)\n\n", queries, k)
+	fmt.Printf("%-12s %12s %12s %12s\n", "", "mean", "p50", "p95")
+	for _, row := range []struct {
+		name      string
+		latencies latencies
+	}{
+		{"knn", knnLatencies},
+		{"brute-force", bruteLatencies},
+	} {
+		fmt.Printf("%-12s %12s %12s %12s\n", row.name, row.latencies.mean(), row.latencies.percentile(0.5), row.latencies.percentile(0.95))
+	}
+	fmt.Printf("\nrecall@%d:   %.3f\n", k, float64(hits)/float64(total))
+
+	return nil
+}
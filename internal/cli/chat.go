@@ -0,0 +1,103 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/vasilisp/semblame/internal/git"
+	"github.com/vasilisp/semblame/pkg/semblame"
+)
+
+const chatHelp = `Ask questions about the repository; follow-ups may refer to earlier answers.
+  /show <rev>  print a commit and add it to the conversation
+  /reset       start a new conversation
+  /help        print this help
+  /quit        leave (or press Ctrl-D)`
+
+// chatCommand handles a line starting with a slash. It returns false when
+// the session should end.
+func chatCommand(ctx context.Context, repoPath string, conversation *semblame.Conversation, line string) bool {
+	command, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch command {
+	case "/show":
+		if arg == "" {
+			fmt.Fprintln(os.Stderr, "usage: /show <rev>")
+			return true
+		}
+
+		commitHash, err := git.ResolveCommit(ctx, repoPath, arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return true
+		}
+
+		commit, err := git.GetCommit(ctx, repoPath, commitHash)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: failed to show %s: %v\n", arg, err)
+			return true
+		}
+		fmt.Print(commit)
+
+		if err := conversation.Add(ctx, commitHash); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+	case "/reset":
+		conversation.Reset()
+		fmt.Fprintln(os.Stderr, "conversation reset")
+	case "/help":
+		fmt.Fprintln(os.Stderr, chatHelp)
+	case "/quit", "/exit":
+		return false
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s; try /help\n", command)
+	}
+
+	return true
+}
+
+// chat runs an interactive session answering questions read from stdin.
+// Errors answering a question are reported and the session goes on.
+func chat(ctx context.Context, repoPath string, filters semblame.Filters, answer answerFlags) error {
+	repo, err := openRepo(ctx, repoPath, answer, os.Stdout)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	conversation, err := repo.Converse(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "type /help for commands")
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(nil, 1<<20)
+
+	for {
+		fmt.Fprint(os.Stderr, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(os.Stderr)
+			return scanner.Err()
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "/"):
+			if !chatCommand(ctx, repoPath, conversation, line) {
+				return nil
+			}
+		default:
+			if _, err := conversation.Ask(ctx, line, filters); err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			}
+		}
+	}
+}
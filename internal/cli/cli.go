@@ -2,142 +2,356 @@ package cli
 
 import (
 	"context"
-	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
 
-	"github.com/vasilisp/semblame/internal/blame"
-	"github.com/vasilisp/semblame/internal/db"
 	"github.com/vasilisp/semblame/internal/git"
-	"github.com/vasilisp/semblame/internal/openai"
-	"github.com/vasilisp/semblame/internal/shared"
-	"github.com/vasilisp/semblame/internal/util"
+	"github.com/vasilisp/semblame/pkg/semblame"
 )
 
-type embeddingDimensions uint16
+func ingest(ctx context.Context, repoPath string, rebuild bool) error {
+	opts := []semblame.Option{semblame.WithWarnings(os.Stderr)}
+	if rebuild {
+		opts = append(opts, semblame.WithRebuild())
+	}
 
-func ingestNote(ctx context.Context, config *git.Config, repoPath, commitHash string) ([]float64, map[string][]float64, error) {
-	var commitEmbedding []float64
-	fileEmbeddings := make(map[string][]float64)
+	repo, err := semblame.Open(ctx, repoPath, opts...)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
 
-	err := git.GetCommitNoteWithCallback(ctx, repoPath, commitHash, func(line []byte) {
-		embeddingJSON, err := openai.UnmarshalJSON(line)
-		if err != nil {
-			log.Fatalf("failed to unmarshal note: %v", err)
-		}
+	stats, err := repo.Ingest(ctx, semblame.IngestOptions{})
 
-		if embeddingJSON.EmbeddingModel() != config.Model || embeddingJSON.EmbeddingDimensions() != config.Dimensions {
-			return
-		}
+	if stats.Refreshed > 0 {
+		fmt.Fprintf(os.Stderr, "refreshed %d stale embeddings\n", stats.Refreshed)
+	}
 
-		embedding, err := embeddingJSON.EmbeddingVector()
-		if err != nil {
-			log.Fatalf("failed to get embedding vector: %v", err)
-		}
+	if stats.Pruned > 0 {
+		fmt.Fprintf(os.Stderr, "pruned %d unreachable commits\n", stats.Pruned)
+	}
 
-		if embeddingJSON.EmbeddingFile() != "" {
-			fileEmbeddings[embeddingJSON.EmbeddingFile()] = embedding
-		} else {
-			commitEmbedding = embedding
-		}
-	})
+	return err
+}
+
+func query(ctx context.Context, repoPath, query string, filters semblame.Filters, format string, answer answerFlags) error {
+	repo, err := openRepo(ctx, repoPath, answer, answerStream(format, os.Stdout))
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	explanation, err := repo.Explain(ctx, query, filters)
+	if err != nil || format == formatText {
+		return err
+	}
+
+	return printJSON(ctx, os.Stdout, format, repoPath, query, explanation.Matches, explanation)
+}
+
+func blameLines(ctx context.Context, repoPath, spec string, filters semblame.Filters, format string, answer answerFlags) error {
+	lines, err := semblame.ParseLineRange(spec)
+	if err != nil {
+		return err
+	}
+
+	repo, err := openRepo(ctx, repoPath, answer, answerStream(format, os.Stdout))
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	explanation, err := repo.ExplainLines(ctx, lines, filters)
+	if err != nil || format == formatText {
+		return err
+	}
+
+	return printJSON(ctx, os.Stdout, format, repoPath, spec, explanation.Matches, explanation)
+}
+
+func symbol(ctx context.Context, repoPath, file, name string, answer answerFlags) error {
+	repo, err := openRepo(ctx, repoPath, answer, os.Stdout)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
+	defer repo.Close()
 
-	return commitEmbedding, fileEmbeddings, nil
+	_, err = repo.ExplainSymbol(ctx, file, name)
+	return err
 }
 
-func ingest(ctx context.Context, repoPath string) error {
-	config := git.NewConfig(ctx, repoPath)
+func notes(ctx context.Context, repoPath, action string) error {
+	if err := git.CheckRepository(ctx, repoPath); err != nil {
+		return err
+	}
 
-	dbh := db.Open(ctx, config.UUID)
-	defer dbh.Close()
+	remote, err := git.NotesRemote(ctx, repoPath)
+	if err != nil {
+		return err
+	}
 
-	db.InitTables(dbh)
+	switch action {
+	case "push":
+		return git.PushNotes(ctx, repoPath, remote)
+	case "pull":
+		return git.PullNotes(ctx, repoPath, remote)
+	default:
+		return fmt.Errorf("unknown notes action: %s", action)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage:
+  semblame ingest [--rebuild] [path/to/repo]
+  semblame query [flags] [path/to/repo] "question"
+  semblame search [flags] [path/to/repo] "query"
+  semblame blame [flags] [path/to/repo] <file>:<line>[-<end>]
+  semblame chat [flags] [path/to/repo]
+  semblame symbol [flags] [path/to/repo] <file> <symbol>
+  semblame notes push|pull [path/to/repo]
+  semblame export [path/to/repo] [output.jsonl]
+  semblame import [--replace] [path/to/repo] input.jsonl
+  semblame bench [path/to/repo] [queries]
+  semblame similar [path/to/repo] <rev>
+  semblame status [path/to/repo]`)
+	os.Exit(2)
+}
+
+func Main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
 
-	client := openai.NewEmbeddingClient(config.Model, config.Dimensions)
+	switch os.Args[1] {
+	case "ingest":
+		fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+		rebuild := fs.Bool("rebuild", false, "empty the index and build it anew for the configured model and dimensions")
+		args := parseFlags(fs, os.Args[2:])
 
-	err := git.GitLog(ctx, repoPath, func(commitHash string, entry string) error {
-		embedding, fileEmbeddings, err := ingestNote(ctx, &config, repoPath, commitHash)
-		if err != nil {
-			return err
+		repoPath := "."
+		switch len(args) {
+		case 0:
+		case 1:
+			repoPath = args[0]
+		default:
+			usage()
 		}
 
-		if embedding == nil {
-			embedding, err = client.Embed(entry)
-			if err != nil {
-				return err
-			}
+		if err := ingest(context.Background(), repoPath, *rebuild); err != nil {
+			log.Fatalf("failed to ingest: %v", err)
+		}
+	case "query":
+		fs := flag.NewFlagSet("query", flag.ExitOnError)
+		var filters semblame.Filters
+		addFilterFlags(fs, &filters, semblame.DefaultLimit)
+		var format string
+		addFormatFlag(fs, &format)
+		var answer answerFlags
+		addAnswerFlags(fs, &answer)
+		args := parseFlags(fs, os.Args[2:])
 
-			util.Assert(config.Dimensions > 0, "dimensions are not set")
+		repoPath := "."
+		switch len(args) {
+		case 1:
+		case 2:
+			repoPath = args[0]
+		default:
+			usage()
+		}
 
-			if config.WriteNotes {
-				embeddingJSON := openai.MakeEmbeddingJSON(openai.EmbeddingTypeCommit, config.Model, config.Dimensions, "", embedding)
+		if err := query(context.Background(), repoPath, args[len(args)-1], filters, format, answer); err != nil {
+			log.Fatalf("failed to query: %v", err)
+		}
+	case "search":
+		fs := flag.NewFlagSet("search", flag.ExitOnError)
+		var filters semblame.Filters
+		addFilterFlags(fs, &filters, semblame.DefaultLimit)
+		explain := fs.Bool("explain", false, "also ask the LLM to answer the query from the results")
+		var format string
+		addFormatFlag(fs, &format)
+		var answer answerFlags
+		addAnswerFlags(fs, &answer)
+		args := parseFlags(fs, os.Args[2:])
 
-				noteBytes, err := json.Marshal(embeddingJSON)
-				if err != nil {
-					return err
-				}
+		repoPath := "."
+		switch len(args) {
+		case 1:
+		case 2:
+			repoPath = args[0]
+		default:
+			usage()
+		}
 
-				git.SetCommitNote(ctx, repoPath, commitHash, string(noteBytes))
-			}
+		if err := search(context.Background(), repoPath, args[len(args)-1], filters, *explain, format, answer); err != nil {
+			log.Fatalf("failed to search: %v", err)
 		}
+	case "blame":
+		fs := flag.NewFlagSet("blame", flag.ExitOnError)
+		var filters semblame.Filters
+		addFilterFlags(fs, &filters, 5)
+		var format string
+		addFormatFlag(fs, &format)
+		var answer answerFlags
+		addAnswerFlags(fs, &answer)
+		args := parseFlags(fs, os.Args[2:])
 
-		db.InsertCommitEmbedding(dbh, commitHash, embedding)
-		for filePath, fileEmbedding := range fileEmbeddings {
-			db.InsertFileEmbedding(dbh, filePath, fileEmbedding)
+		repoPath := "."
+		switch len(args) {
+		case 1:
+		case 2:
+			repoPath = args[0]
+		default:
+			usage()
 		}
 
-		return nil
-	})
-	if err != nil {
-		log.Fatalf("failed to ingest: %v", err)
-	}
+		if err := blameLines(context.Background(), repoPath, args[len(args)-1], filters, format, answer); err != nil {
+			log.Fatalf("failed to blame: %v", err)
+		}
+	case "chat":
+		fs := flag.NewFlagSet("chat", flag.ExitOnError)
+		var filters semblame.Filters
+		addFilterFlags(fs, &filters, semblame.DefaultLimit)
+		var answer answerFlags
+		addAnswerFlags(fs, &answer)
+		args := parseFlags(fs, os.Args[2:])
 
-	return nil
-}
+		repoPath := "."
+		switch len(args) {
+		case 0:
+		case 1:
+			repoPath = args[0]
+		default:
+			usage()
+		}
 
-func similarityQuery(ctx context.Context, repoPath, query string) []shared.Match {
-	config := git.NewConfig(ctx, repoPath)
+		if err := chat(context.Background(), repoPath, filters, answer); err != nil {
+			log.Fatalf("failed to chat: %v", err)
+		}
+	case "symbol":
+		fs := flag.NewFlagSet("symbol", flag.ExitOnError)
+		var answer answerFlags
+		addAnswerFlags(fs, &answer)
+		args := parseFlags(fs, os.Args[2:])
 
-	dbh := db.Open(ctx, config.UUID)
-	defer dbh.Close()
+		repoPath := "."
+		switch len(args) {
+		case 2:
+		case 3:
+			repoPath = args[0]
+			args = args[1:]
+		default:
+			usage()
+		}
 
-	client := openai.NewEmbeddingClient(config.Model, config.Dimensions)
+		if err := symbol(context.Background(), repoPath, args[0], args[1], answer); err != nil {
+			log.Fatalf("failed to explain symbol: %v", err)
+		}
+	case "notes":
+		if len(os.Args) < 3 {
+			usage()
+		}
 
-	embedding, err := client.Embed(query)
-	if err != nil {
-		log.Fatalf("failed to embed query: %v", err)
-	}
+		repoPath := "."
+		if len(os.Args) > 3 {
+			repoPath = os.Args[3]
+		}
 
-	results, err := db.QueryCommitEmbeddings(dbh, embedding, 10)
-	if err != nil {
-		log.Fatalf("failed to query commit embeddings: %v", err)
-	}
+		if err := notes(context.Background(), repoPath, os.Args[2]); err != nil {
+			log.Fatalf("failed to %s notes: %v", os.Args[2], err)
+		}
+	case "export":
+		repoPath := "."
+		if len(os.Args) > 2 {
+			repoPath = os.Args[2]
+		}
 
-	return results
-}
+		out := os.Stdout
+		if len(os.Args) > 3 {
+			f, err := os.Create(os.Args[3])
+			if err != nil {
+				log.Fatalf("failed to create export file: %v", err)
+			}
+			defer f.Close()
+			out = f
+		}
+
+		if err := export(context.Background(), repoPath, out); err != nil {
+			log.Fatalf("failed to export: %v", err)
+		}
+	case "import":
+		fs := flag.NewFlagSet("import", flag.ExitOnError)
+		replace := fs.Bool("replace", false, "replace the embeddings already in the index")
+		args := parseFlags(fs, os.Args[2:])
 
-func Main() {
-	if len(os.Args) > 1 && os.Args[1] == "ingest" {
+		repoPath := "."
+		switch len(args) {
+		case 1:
+		case 2:
+			repoPath = args[0]
+		default:
+			usage()
+		}
+		inPath := args[len(args)-1]
+
+		in := os.Stdin
+		if inPath != "-" {
+			f, err := os.Open(inPath)
+			if err != nil {
+				log.Fatalf("failed to open import file: %v", err)
+			}
+			defer f.Close()
+			in = f
+		}
+
+		if err := importIndex(context.Background(), repoPath, in, *replace); err != nil {
+			log.Fatalf("failed to import: %v", err)
+		}
+	case "bench":
 		repoPath := "."
 		if len(os.Args) > 2 {
 			repoPath = os.Args[2]
 		}
 
-		if err := ingest(context.Background(), repoPath); err != nil {
-			panic(err)
+		queries := 100
+		if len(os.Args) > 3 {
+			n, err := strconv.Atoi(os.Args[3])
+			if err != nil || n <= 0 {
+				usage()
+			}
+			queries = n
 		}
-		return
-	}
 
-	if len(os.Args) >= 4 && os.Args[1] == "query" {
-		repoPath := os.Args[2]
-		query := os.Args[3]
+		if err := bench(context.Background(), repoPath, queries, 10); err != nil {
+			log.Fatalf("failed to run benchmark: %v", err)
+		}
+	case "similar":
+		if len(os.Args) < 3 {
+			usage()
+		}
+
+		repoPath := "."
+		rev := os.Args[2]
+		if len(os.Args) > 3 {
+			repoPath = os.Args[2]
+			rev = os.Args[3]
+		}
 
-		results := similarityQuery(context.Background(), repoPath, query)
+		if err := similar(context.Background(), repoPath, rev, 10); err != nil {
+			log.Fatalf("failed to find similar commits: %v", err)
+		}
+	case "status":
+		repoPath := "."
+		if len(os.Args) > 2 {
+			repoPath = os.Args[2]
+		}
 
-		blame.Blame(context.Background(), repoPath, results, query)
+		if err := status(context.Background(), repoPath); err != nil {
+			log.Fatalf("failed to get status: %v", err)
+		}
+	default:
+		usage()
 	}
 }
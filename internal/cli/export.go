@@ -0,0 +1,307 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/vasilisp/semblame/internal/db"
+	"github.com/vasilisp/semblame/internal/git"
+	"github.com/vasilisp/semblame/internal/shared"
+)
+
+const (
+	exportFormat  = "semblame-index"
+	exportVersion = 1
+)
+
+// exportHeader is the first line of an export archive. It describes the
+// records that follow.
+type exportHeader struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	Model      string    `json:"model"`
+	Dimensions uint32    `json:"dimensions"`
+	Created    time.Time `json:"created"`
+}
+
+type exportMetadata struct {
+	Author  string    `json:"author"`
+	Date    time.Time `json:"date"`
+	Subject string    `json:"subject"`
+	Parents []string  `json:"parents,omitempty"`
+}
+
+// exportRecord is a single embedding in an export archive. Commit embeddings
+// have Commit set and File empty; file embeddings the other way around.
+type exportRecord struct {
+	Commit     string          `json:"commit,omitempty"`
+	Model      string          `json:"model"`
+	Dimensions uint32          `json:"dimensions"`
+	Type       string          `json:"type"`
+	File       string          `json:"file,omitempty"`
+	Vector     []float64       `json:"vector"`
+	Metadata   *exportMetadata `json:"metadata,omitempty"`
+}
+
+// export writes the index of the repository at repoPath to w as JSON lines: a
+// header followed by one record per embedding.
+func export(ctx context.Context, repoPath string, w io.Writer) error {
+	config, err := git.NewConfig(ctx, repoPath)
+	if err != nil {
+		return err
+	}
+
+	dbh, err := db.Open(ctx, config.DBPath, config.Model, config.Dimensions)
+	if err != nil {
+		return err
+	}
+	defer dbh.Close()
+
+	var commitHashes []string
+	err = db.ForEachCommitEmbedding(dbh, func(commitHash string, _ []float64) error {
+		commitHashes = append(commitHashes, commitHash)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	infos, err := git.CommitInfos(ctx, repoPath, commitHashes)
+	if err != nil {
+		return fmt.Errorf("failed to get commit metadata: %w", err)
+	}
+
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+
+	err = encoder.Encode(exportHeader{
+		Format:     exportFormat,
+		Version:    exportVersion,
+		Model:      config.Model.String(),
+		Dimensions: config.Dimensions,
+		Created:    time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = db.ForEachCommitEmbedding(dbh, func(commitHash string, embedding []float64) error {
+		record := exportRecord{
+			Commit:     commitHash,
+			Model:      config.Model.String(),
+			Dimensions: config.Dimensions,
+			Type:       "commit",
+			Vector:     embedding,
+		}
+
+		if info, ok := infos[commitHash]; ok {
+			record.Metadata = &exportMetadata{
+				Author:  info.Author,
+				Date:    info.Date.UTC(),
+				Subject: info.Subject,
+				Parents: info.Parents,
+			}
+		}
+
+		return encoder.Encode(record)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = db.ForEachFileEmbedding(dbh, func(filePath string, embedding []float64) error {
+		return encoder.Encode(exportRecord{
+			Model:      config.Model.String(),
+			Dimensions: config.Dimensions,
+			Type:       "file",
+			File:       filePath,
+			Vector:     embedding,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// importBatchSize is the number of commit records looked up in the object
+// store at once.
+const importBatchSize = 1000
+
+// importIndex loads an archive produced by export into the index of the
+// repository at repoPath. The archive must have been produced with the model
+// and dimensions the repository is configured for. The index must be empty,
+// unless replace is set, in which case it is cleared first. Commits missing
+// from the repository are skipped; the messages and diffs of the others are
+// read from it for the lexical index.
+func importIndex(ctx context.Context, repoPath string, r io.Reader, replace bool) error {
+	config, err := git.NewConfig(ctx, repoPath)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := git.LockIngest(ctx, repoPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	vectors, err := db.OpenStore(ctx, config.DBPath, config.Model, config.Dimensions)
+	if err != nil {
+		return err
+	}
+	// discards the batch unless it was committed
+	defer vectors.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(r))
+
+	var header exportHeader
+	if err := decoder.Decode(&header); err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+
+	if header.Format != exportFormat {
+		return fmt.Errorf("not a semblame export: format %q", header.Format)
+	}
+
+	if header.Version > exportVersion {
+		return fmt.Errorf("unsupported export version %d (newest supported is %d)", header.Version, exportVersion)
+	}
+
+	if header.Model != config.Model.String() {
+		return fmt.Errorf("%w: export was made with %s, repository is configured for %s",
+			shared.ErrModelMismatch, header.Model, config.Model)
+	}
+
+	if header.Dimensions != config.Dimensions {
+		return fmt.Errorf("%w: export has %d dimensions, repository is configured for %d",
+			shared.ErrDimensionMismatch, header.Dimensions, config.Dimensions)
+	}
+
+	stats, err := vectors.Stats()
+	if err != nil {
+		return err
+	}
+
+	if !replace && (stats.Commits > 0 || stats.Files > 0) {
+		return fmt.Errorf("index already has %d commit and %d file embeddings; use --replace to replace them", stats.Commits, stats.Files)
+	}
+
+	// the archive is imported in one transaction, so that a malformed record
+	// leaves the index untouched
+	if err := vectors.BeginBatch(); err != nil {
+		return err
+	}
+
+	if replace {
+		if err := vectors.Clear(); err != nil {
+			return err
+		}
+	}
+
+	commits, files, skipped := 0, 0, 0
+	var pending []exportRecord
+
+	// flush writes the pending commit records whose commits exist locally
+	flush := func() error {
+		hashes := make([]string, len(pending))
+		for i, record := range pending {
+			hashes[i] = record.Commit
+		}
+
+		existing, err := git.ExistingCommits(ctx, repoPath, hashes)
+		if err != nil {
+			return fmt.Errorf("failed to look up commits: %w", err)
+		}
+
+		var imported []string
+		for _, record := range pending {
+			if !existing[record.Commit] {
+				skipped++
+				continue
+			}
+
+			info := shared.CommitInfo{Hash: record.Commit}
+			if record.Metadata != nil {
+				info.Author = record.Metadata.Author
+				info.Date = record.Metadata.Date
+				info.Subject = record.Metadata.Subject
+				info.Parents = record.Metadata.Parents
+			}
+
+			if err := vectors.Upsert(info, record.Vector); err != nil {
+				return err
+			}
+			imported = append(imported, record.Commit)
+			commits++
+		}
+
+		pending = pending[:0]
+
+		// the archive has no text to match queries against; it is read
+		// from the repository, as ingest would
+		err = git.CommitEntries(ctx, repoPath, imported, config.Ignore, func(commitHash, entry string) error {
+			message, diff := git.SplitEntry(entry)
+			return vectors.IndexText(commitHash, message, diff)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to index commit text: %w", err)
+		}
+
+		return nil
+	}
+
+	for {
+		var record exportRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read record: %w", err)
+		}
+
+		if record.Model != header.Model || record.Dimensions != header.Dimensions || uint32(len(record.Vector)) != header.Dimensions {
+			return fmt.Errorf("%w: record does not match header model %s/%d", shared.ErrDimensionMismatch, header.Model, header.Dimensions)
+		}
+
+		switch record.Type {
+		case "commit":
+			pending = append(pending, record)
+			if len(pending) < importBatchSize {
+				continue
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+		case "file":
+			if err := vectors.UpsertFile(record.File, record.Vector); err != nil {
+				return err
+			}
+			files++
+		default:
+			return fmt.Errorf("invalid record type: %s", record.Type)
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if err := vectors.EndBatch(true); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "imported %d commit and %d file embeddings\n", commits, files)
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d commits not in the repository; fetch them and import again to include them\n", skipped)
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/vasilisp/semblame/pkg/semblame"
+)
+
+// parseFlags parses args with fs, allowing flags to come after positional
+// arguments, and returns the positional arguments.
+func parseFlags(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// dateFlag is a flag.Value accepting a date (YYYY-MM-DD) or an RFC 3339
+// timestamp. A date given for an upper bound stands for the end of that day.
+type dateFlag struct {
+	t          *time.Time
+	upperBound bool
+}
+
+func (d dateFlag) String() string {
+	if d.t == nil || d.t.IsZero() {
+		return ""
+	}
+	return d.t.Format(time.RFC3339)
+}
+
+func (d dateFlag) Set(s string) error {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		*d.t = t
+		return nil
+	}
+
+	t, err := time.ParseInLocation(time.DateOnly, s, time.Local)
+	if err != nil {
+		return fmt.Errorf("expected YYYY-MM-DD or an RFC 3339 timestamp")
+	}
+
+	if d.upperBound {
+		t = t.AddDate(0, 0, 1).Add(-time.Second)
+	}
+	*d.t = t
+
+	return nil
+}
+
+// addFilterFlags registers the retrieval filters on fs, with topK as the
+// default number of commits retrieved.
+func addFilterFlags(fs *flag.FlagSet, filters *semblame.Filters, topK int) {
+	fs.StringVar(&filters.Author, "author", "", "only commits whose author matches the `regexp` (case-insensitive)")
+	fs.Var(dateFlag{t: &filters.Since}, "since", "only commits made on or after `date`")
+	fs.Var(dateFlag{t: &filters.Until, upperBound: true}, "until", "only commits made on or before `date`")
+	fs.StringVar(&filters.Path, "path", "", "only commits touching a path matching the `glob`")
+	fs.StringVar(&filters.Branch, "branch", "", "only commits reachable from `rev`")
+	fs.BoolVar(&filters.ExcludeMerges, "exclude-merges", false, "leave out merge commits")
+	fs.IntVar(&filters.Limit, "top-k", topK, "number of commits to retrieve")
+	fs.Float64Var(&filters.MaxDistance, "max-distance", 0, "drop commits farther than this cosine `distance` from the question")
+}
+
+// answerFlags are the flags shaping the LLM's answers.
+type answerFlags struct {
+	chatModel string
+	style     string
+}
+
+// addAnswerFlags registers --chat-model and --style on fs.
+func addAnswerFlags(fs *flag.FlagSet, answer *answerFlags) {
+	fs.StringVar(&answer.chatModel, "chat-model", "", "chat `model` answering the question (default per semblame.chatModel)")
+	fs.StringVar(&answer.style, "style", "", "answer `style`: summary, detailed or timeline (default detailed)")
+}
+
+// openRepo opens the repository at repoPath per answer, streaming answers to
+// stream and warnings to stderr.
+func openRepo(ctx context.Context, repoPath string, answer answerFlags, stream io.Writer) (*semblame.Repo, error) {
+	return semblame.Open(ctx, repoPath,
+		semblame.WithChatModel(answer.chatModel),
+		semblame.WithStyle(answer.style),
+		semblame.WithStream(stream),
+		semblame.WithWarnings(os.Stderr),
+	)
+}
@@ -0,0 +1,201 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/vasilisp/semblame/internal/git"
+	"github.com/vasilisp/semblame/pkg/semblame"
+)
+
+const (
+	formatText  = "text"
+	formatJSON  = "json"
+	formatJSONL = "jsonl"
+)
+
+// formatFlag is a flag.Value selecting how results are printed: as text, as
+// a single JSON object, or as JSON lines events.
+type formatFlag struct {
+	format *string
+}
+
+func (f formatFlag) String() string {
+	if f.format == nil {
+		return ""
+	}
+	return *f.format
+}
+
+func (f formatFlag) Set(s string) error {
+	switch s {
+	case formatText, formatJSON, formatJSONL:
+		*f.format = s
+		return nil
+	default:
+		return fmt.Errorf("expected %s, %s or %s", formatText, formatJSON, formatJSONL)
+	}
+}
+
+// addFormatFlag registers --format on fs, defaulting to text.
+func addFormatFlag(fs *flag.FlagSet, format *string) {
+	*format = formatText
+	fs.Var(formatFlag{format: format}, "format", "output `format`: text, json or jsonl")
+}
+
+// jsonMatch is a retrieved commit. Direct is set for commits that changed the
+// explained lines, as opposed to being retrieved for them.
+type jsonMatch struct {
+	Hash     string    `json:"hash"`
+	Distance float64   `json:"distance"`
+	Direct   bool      `json:"direct"`
+	Author   string    `json:"author"`
+	Date     time.Time `json:"date"`
+	Subject  string    `json:"subject"`
+	// Missing is set for indexed commits the repository does not have, whose
+	// metadata is unknown.
+	Missing bool `json:"missing,omitempty"`
+}
+
+// jsonCitation is a commit the answer refers to, with the line of the answer
+// that does.
+type jsonCitation struct {
+	Hash   string `json:"hash"`
+	Reason string `json:"reason"`
+}
+
+// jsonResult is the output of --format json. Answer and Citations are left
+// out when the LLM was not asked.
+type jsonResult struct {
+	Query     string         `json:"query"`
+	Matches   []jsonMatch    `json:"matches"`
+	Answer    *string        `json:"answer,omitempty"`
+	Citations []jsonCitation `json:"citations,omitempty"`
+}
+
+// Lines of --format jsonl output are events, told apart by their type: "text"
+// for a piece of the answer as it is written, then "match" and "citation" for
+// each match and citation, and "answer" last with the whole answer.
+type (
+	jsonTextEvent struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	jsonMatchEvent struct {
+		Type string `json:"type"`
+		jsonMatch
+	}
+	jsonCitationEvent struct {
+		Type string `json:"type"`
+		jsonCitation
+	}
+)
+
+// jsonlStream is an io.Writer turning each write into a "text" event.
+type jsonlStream struct {
+	enc *json.Encoder
+}
+
+func (s jsonlStream) Write(p []byte) (int, error) {
+	if err := s.enc.Encode(jsonTextEvent{Type: "text", Text: string(p)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// answerStream returns the writer the answer should stream to for format.
+func answerStream(format string, w io.Writer) io.Writer {
+	switch format {
+	case formatJSON:
+		return io.Discard
+	case formatJSONL:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		return jsonlStream{enc: enc}
+	default:
+		return w
+	}
+}
+
+// jsonMatches adds commit metadata to matches, the first direct of which are
+// direct.
+func jsonMatches(ctx context.Context, repoPath string, matches []semblame.Match, direct int) ([]jsonMatch, error) {
+	hashes := make([]string, len(matches))
+	for i, match := range matches {
+		hashes[i] = match.CommitHash
+	}
+
+	infos, err := git.CommitInfos(ctx, repoPath, hashes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commit metadata: %w", err)
+	}
+
+	result := make([]jsonMatch, len(matches))
+	for i, match := range matches {
+		info, ok := infos[match.CommitHash]
+		result[i] = jsonMatch{
+			Hash:     match.CommitHash,
+			Distance: match.Distance,
+			Direct:   i < direct,
+			Author:   info.Author,
+			Date:     info.Date,
+			Subject:  info.Subject,
+			Missing:  !ok,
+		}
+	}
+
+	return result, nil
+}
+
+// printJSON prints matches and, unless explanation is nil, the answer and its
+// citations to w in format json or jsonl.
+func printJSON(ctx context.Context, w io.Writer, format, repoPath, query string, matches []semblame.Match, explanation *semblame.Explanation) error {
+	direct := 0
+	if explanation != nil {
+		direct = explanation.Direct
+	}
+
+	result := jsonResult{Query: query}
+
+	var err error
+	if result.Matches, err = jsonMatches(ctx, repoPath, matches, direct); err != nil {
+		return err
+	}
+
+	if explanation != nil {
+		result.Answer = &explanation.Answer
+		for _, citation := range explanation.Citations {
+			result.Citations = append(result.Citations, jsonCitation{Hash: citation.CommitHash, Reason: citation.Reason})
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	if format == formatJSON {
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+
+	for _, match := range result.Matches {
+		if err := enc.Encode(jsonMatchEvent{Type: "match", jsonMatch: match}); err != nil {
+			return err
+		}
+	}
+
+	for _, citation := range result.Citations {
+		if err := enc.Encode(jsonCitationEvent{Type: "citation", jsonCitation: citation}); err != nil {
+			return err
+		}
+	}
+
+	if result.Answer != nil {
+		return enc.Encode(jsonTextEvent{Type: "answer", Text: *result.Answer})
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vasilisp/semblame/internal/git"
+	"github.com/vasilisp/semblame/pkg/semblame"
+)
+
+// printMatches prints matches in the style of git log, with the distance from
+// the query under the date. Commits the repository does not have are marked
+// as such.
+func printMatches(ctx context.Context, w io.Writer, repoPath string, matches []semblame.Match) error {
+	hashes := make([]string, len(matches))
+	for i, match := range matches {
+		hashes[i] = match.CommitHash
+	}
+
+	infos, err := git.CommitInfos(ctx, repoPath, hashes)
+	if err != nil {
+		return fmt.Errorf("failed to get commit metadata: %w", err)
+	}
+
+	for i, match := range matches {
+		info, ok := infos[match.CommitHash]
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		if !ok {
+			fmt.Fprintf(w, "commit %s (not in this repository)\n", match.CommitHash)
+			fmt.Fprintf(w, "Distance: %.4f\n", match.Distance)
+			continue
+		}
+		fmt.Fprintf(w, "commit %s\n", match.CommitHash)
+		fmt.Fprintf(w, "Author:   %s\n", info.Author)
+		fmt.Fprintf(w, "Date:     %s\n", info.Date.Format("Mon Jan 2 15:04:05 2006 -0700"))
+		fmt.Fprintf(w, "Distance: %.4f\n", match.Distance)
+		fmt.Fprintf(w, "\n    %s\n", info.Subject)
+	}
+
+	return nil
+}
+
+// search prints the commits retrieved for query without calling the LLM,
+// unless explain is set.
+func search(ctx context.Context, repoPath, query string, filters semblame.Filters, explain bool, format string, answer answerFlags) error {
+	repo, err := openRepo(ctx, repoPath, answer, answerStream(format, os.Stdout))
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	matches, err := repo.Search(ctx, query, filters)
+	if err != nil {
+		return err
+	}
+
+	if format == formatText {
+		if err := printMatches(ctx, os.Stdout, repoPath, matches); err != nil {
+			return err
+		}
+	}
+
+	var explanation *semblame.Explanation
+	if explain && len(matches) > 0 {
+		if format == formatText {
+			fmt.Println()
+		}
+
+		if explanation, err = repo.ExplainMatches(ctx, query, matches); err != nil {
+			return err
+		}
+	}
+
+	if format == formatText {
+		return nil
+	}
+
+	return printJSON(ctx, os.Stdout, format, repoPath, query, matches, explanation)
+}
@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/vasilisp/semblame/internal/git"
+	"github.com/vasilisp/semblame/pkg/semblame"
+)
+
+// similar lists the n indexed commits nearest to the commit rev refers to.
+func similar(ctx context.Context, repoPath, rev string, n int) error {
+	repo, err := semblame.Open(ctx, repoPath, semblame.WithWarnings(os.Stderr))
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	matches, err := repo.Similar(ctx, rev, semblame.Filters{Limit: n})
+	if err != nil {
+		return err
+	}
+
+	hashes := make([]string, len(matches))
+	for i, match := range matches {
+		hashes[i] = match.CommitHash
+	}
+
+	infos, err := git.CommitInfos(ctx, repoPath, hashes)
+	if err != nil {
+		return fmt.Errorf("failed to get commit metadata: %w", err)
+	}
+
+	for _, match := range matches {
+		info, ok := infos[match.CommitHash]
+		if !ok {
+			fmt.Printf("%.10s  %.4f  (not in this repository)\n", match.CommitHash, match.Distance)
+			continue
+		}
+		fmt.Printf("%.10s  %.4f  %s  %s\n", match.CommitHash, match.Distance, info.Date.Format("2006-01-02"), info.Subject)
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+
+	"github.com/vasilisp/semblame/internal/db"
+	"github.com/vasilisp/semblame/internal/git"
+	"github.com/vasilisp/semblame/internal/shared"
+)
+
+// dbSize returns the size on disk of the database at path, including its WAL
+// and shared-memory files.
+func dbSize(path string) (int64, error) {
+	var total int64
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		info, err := os.Stat(path + suffix)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		total += info.Size()
+	}
+
+	return total, nil
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func formatCommit(info shared.CommitInfo) string {
+	return fmt.Sprintf("%.10s  %s  %s", info.Hash, info.Date.Format("2006-01-02"), info.Subject)
+}
+
+// status prints what the index of the repository contains, and how it
+// compares to the history ingest would walk. A missing database is reported
+// rather than created.
+func status(ctx context.Context, repoPath string) error {
+	config, err := git.ReadConfig(ctx, repoPath)
+	if err != nil {
+		return err
+	}
+
+	if config.DBPath == "" {
+		fmt.Println("status:        no index; run ingest")
+		return nil
+	}
+
+	fmt.Printf("database:      %s\n", config.DBPath)
+	fmt.Printf("model:         %s (%d dimensions)\n", config.Model, config.Dimensions)
+
+	if _, err := os.Stat(config.DBPath); errors.Is(err, fs.ErrNotExist) {
+		fmt.Println("status:        no index; run ingest")
+		return nil
+	}
+
+	// opened read-only, so that status neither migrates the database nor
+	// fails on a configuration it was not built for
+	vectors, err := db.OpenStoreReadOnly(config.DBPath)
+	if err != nil {
+		return err
+	}
+	defer vectors.Close()
+
+	version, err := db.SchemaVersion(vectors.DB())
+	if err != nil {
+		return fmt.Errorf("failed to get schema version: %w", err)
+	}
+
+	size, err := dbSize(config.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to get database size: %w", err)
+	}
+
+	fmt.Printf("schema:        version %d\n", version)
+	fmt.Printf("size:          %s\n", formatSize(size))
+
+	if version > db.LatestSchemaVersion {
+		fmt.Printf("status:        created by a newer semblame (newest supported schema is %d); upgrade semblame\n", db.LatestSchemaVersion)
+		return nil
+	}
+
+	if version < db.LatestSchemaVersion {
+		fmt.Println("status:        schema out of date; run ingest to migrate it")
+		return nil
+	}
+
+	storedModel, err := db.Setting(vectors.DB(), "model")
+	if err != nil {
+		return fmt.Errorf("failed to get database model: %w", err)
+	}
+
+	storedDimensions, err := db.Setting(vectors.DB(), "dimensions")
+	if err != nil {
+		return fmt.Errorf("failed to get database dimensions: %w", err)
+	}
+
+	if storedModel != config.Model.String() || storedDimensions != strconv.FormatUint(uint64(config.Dimensions), 10) {
+		fmt.Printf("status:        built for %s (%s dimensions); run ingest --rebuild\n", storedModel, storedDimensions)
+		return nil
+	}
+
+	stats, err := vectors.Stats()
+	if err != nil {
+		return err
+	}
+
+	indexed, err := db.IndexedCommits(vectors.DB())
+	if err != nil {
+		return err
+	}
+
+	hasText, err := vectors.HasTextIndex()
+	if err != nil {
+		return fmt.Errorf("failed to check lexical index: %w", err)
+	}
+
+	reachable, err := git.LogCommitInfos(ctx, repoPath)
+	if err != nil {
+		return fmt.Errorf("failed to list commits: %w", err)
+	}
+
+	noted, err := git.NotedCommits(ctx, repoPath)
+	if err != nil {
+		return fmt.Errorf("failed to list notes: %w", err)
+	}
+
+	var missing, withNotes int
+	var oldest, newest shared.CommitInfo
+	for commitHash, info := range reachable {
+		if noted[commitHash] {
+			withNotes++
+		}
+
+		if !indexed[commitHash] {
+			missing++
+			continue
+		}
+
+		if oldest.Hash == "" || info.Date.Before(oldest.Date) {
+			oldest = info
+		}
+		if newest.Hash == "" || info.Date.After(newest.Date) {
+			newest = info
+		}
+	}
+
+	// indexed commits that no ref reaches any more, e.g. after a rebase,
+	// which the next ingest prunes
+	refs, err := git.ReachableCommits(ctx, repoPath)
+	if err != nil {
+		return err
+	}
+
+	unreachable := 0
+	for commitHash := range indexed {
+		if !refs[commitHash] {
+			unreachable++
+		}
+	}
+
+	fmt.Printf("lexical index: %t\n", hasText)
+	fmt.Printf("commits:       %d indexed, %d reachable", stats.Commits, len(reachable))
+	if unreachable > 0 {
+		fmt.Printf(", %d indexed but unreachable (pruned by ingest)", unreachable)
+	}
+	fmt.Println()
+	fmt.Printf("files:         %d indexed\n", stats.Files)
+	fmt.Printf("notes:         %d of %d reachable commits\n", withNotes, len(reachable))
+	if oldest.Hash != "" {
+		fmt.Printf("oldest:        %s\n", formatCommit(oldest))
+		fmt.Printf("newest:        %s\n", formatCommit(newest))
+	}
+
+	if missing == 0 {
+		fmt.Println("status:        up to date")
+	} else {
+		fmt.Printf("status:        behind HEAD by %d commits; run ingest\n", missing)
+	}
+
+	return nil
+}
@@ -1,8 +1,17 @@
 package data
 
 import (
-	_ "embed"
+	"embed"
 )
 
+// SystemPrompt is the default system prompt template. See
+// blame.PromptData for the variables it may use.
+//
 //go:embed prompt.txt
 var SystemPrompt string
+
+// Styles holds the answer structures selectable with --style, as
+// styles/<name>.txt.
+//
+//go:embed styles/*.txt
+var Styles embed.FS
@@ -3,14 +3,19 @@ package db
 import (
 	"context"
 	"database/sql"
+	"encoding/binary"
 	"fmt"
-	"log"
+	"math"
+	"net/url"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	sqlite_vec "github.com/asg017/sqlite-vec-go-bindings/cgo"
-	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/vasilisp/semblame/internal/shared"
+	"github.com/vasilisp/semblame/internal/store"
 )
 
 const createCommitsTableSQL = `
@@ -27,93 +32,241 @@ CREATE TABLE IF NOT EXISTS file_embeddings (
 );
 `
 
-// InitTables initializes the commit_embeddings and file_embeddings tables.
-func InitTables(db *sql.DB) {
-	_, err := db.Exec(createCommitsTableSQL)
+// busyTimeout is how long, in milliseconds, a connection waits for another
+// process holding the write lock (e.g. a background ingest) before failing.
+const busyTimeout = 10000
+
+// Open opens (creating if needed) the database at path, along with its parent
+// directory, in WAL mode, and migrates it to the latest schema version. The database must
+// have been built for the given model and dimensions; otherwise
+// shared.ErrModelMismatch or shared.ErrDimensionMismatch is returned.
+func Open(ctx context.Context, path string, model shared.EmbeddingModel, dimensions uint32) (*sql.DB, error) {
+	db, err := openMigrated(path, model, dimensions)
 	if err != nil {
-		log.Fatalf("failed to create commit_embeddings table: %v", err)
+		return nil, err
+	}
+
+	if err := checkSettings(db, model, dimensions); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	_, err = db.Exec(createFilesTableSQL)
+	return db, nil
+}
+
+// openMigrated opens (creating if needed) the database at path, along with
+// its parent directory, in WAL mode, and migrates it to the latest schema
+// version.
+func openMigrated(path string, model shared.EmbeddingModel, dimensions uint32) (*sql.DB, error) {
+	sqlite_vec.Auto()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	// WAL lets queries read while an ingest writes, and immediate
+	// transactions take the write lock upfront, so that writers wait out the
+	// busy timeout instead of failing to upgrade a read lock.
+	dsn := fmt.Sprintf("%s?_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate", path, busyTimeout)
+
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
-		log.Fatalf("failed to create file_embeddings table: %v", err)
+		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
+
+	if err := Migrate(db, model, dimensions); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	return db, nil
 }
 
-func Open(ctx context.Context, uuid uuid.UUID) *sql.DB {
+// OpenReadOnly opens the existing database at path for reading only, without
+// migrating it or checking its settings, e.g. to report on it.
+func OpenReadOnly(path string) (*sql.DB, error) {
 	sqlite_vec.Auto()
 
-	db, err := sql.Open("sqlite3", filepath.Join("/home/vasilis/.semblame", uuid.String()+".sqlite"))
+	// the path is escaped, so that e.g. '?' or '#' in it is not taken for
+	// query parameters
+	dsn := (&url.URL{
+		Scheme:   "file",
+		Opaque:   url.PathEscape(path),
+		RawQuery: fmt.Sprintf("mode=ro&_busy_timeout=%d", busyTimeout),
+	}).String()
+
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
-		log.Fatalf("failed to open database: %v", err)
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
-	InitTables(db)
 
-	return db
+	return db, nil
 }
 
-// InsertCommitEmbedding inserts or replaces a commit hash and its embedding vector.
-func InsertCommitEmbedding(db *sql.DB, commitHash string, embedding []float64) {
-	// Serialize the embedding slice into the vector BLOB format.
-	floats := make([]float32, len(embedding))
-	for i, v := range embedding {
-		floats[i] = float32(v)
+// Rebuild empties the database at path (creating it if needed) and sets it
+// up for the given model and dimensions, so that it can be ingested again
+// after either changed.
+func Rebuild(ctx context.Context, path string, model shared.EmbeddingModel, dimensions uint32) error {
+	db, err := openMigrated(path, model, dimensions)
+	if err != nil {
+		return err
 	}
+	defer db.Close()
 
-	blob, err := sqlite_vec.SerializeFloat32(floats)
+	tx, err := db.Begin()
 	if err != nil {
-		log.Fatalf("failed to serialize commit embedding: %v", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	_, err = db.Exec(
-		"INSERT OR REPLACE INTO commit_embeddings (commit_hash, embedding) VALUES (?, ?)",
-		commitHash, blob,
+	statements := []string{
+		"DELETE FROM commits",
+		"DELETE FROM commit_fts",
+		"DELETE FROM file_embeddings",
+		"DROP TABLE commit_vectors",
+		fmt.Sprintf(createCommitVectorsTableSQL, dimensions),
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to rebuild database: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(
+		"INSERT OR REPLACE INTO settings (key, value) VALUES ('model', ?), ('dimensions', ?)",
+		model.String(), dimensions,
 	)
 	if err != nil {
-		log.Fatalf("failed to insert commit embedding: %v", err)
+		return fmt.Errorf("failed to record settings: %w", err)
 	}
+
+	return tx.Commit()
 }
 
-func InsertFileEmbedding(db *sql.DB, filePath string, embedding []float64) {
-	floats := make([]float32, len(embedding))
-	for i, v := range embedding {
-		floats[i] = float32(v)
+// Setting returns the value of a key in the settings table, or the empty
+// string if it is not set.
+func Setting(db *sql.DB, key string) (string, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
 	}
 
-	blob, err := sqlite_vec.SerializeFloat32(floats)
+	return value, err
+}
+
+func checkSettings(db *sql.DB, model shared.EmbeddingModel, dimensions uint32) error {
+	storedModel, err := Setting(db, "model")
 	if err != nil {
-		log.Fatalf("failed to serialize file embedding: %v", err)
+		return fmt.Errorf("failed to get database model: %v", err)
 	}
 
-	_, err = db.Exec(
-		"INSERT OR REPLACE INTO file_embeddings (file_path, embedding) VALUES (?, ?)",
-		filePath, blob,
-	)
+	storedDimensions, err := Setting(db, "dimensions")
 	if err != nil {
-		log.Fatalf("failed to insert file embedding: %v", err)
+		return fmt.Errorf("failed to get database dimensions: %v", err)
 	}
+
+	if storedModel != model.String() {
+		return fmt.Errorf("%w: database was built for %s but %s is configured; run semblame ingest --rebuild or use a different semblame.dbPath",
+			shared.ErrModelMismatch, storedModel, model)
+	}
+
+	if storedDimensions != strconv.FormatUint(uint64(dimensions), 10) {
+		return fmt.Errorf("%w: database was built for %s dimensions but %d are configured; run semblame ingest --rebuild or use a different semblame.dbPath",
+			shared.ErrDimensionMismatch, storedDimensions, dimensions)
+	}
+
+	return nil
 }
 
-func QueryCommitEmbeddings(db *sql.DB, embedding []float64, n int) ([]shared.Match, error) {
+func serializeFloat32(embedding []float64) ([]byte, error) {
 	floats := make([]float32, len(embedding))
 	for i, v := range embedding {
 		floats[i] = float32(v)
 	}
 
-	blob, err := sqlite_vec.SerializeFloat32(floats)
+	return sqlite_vec.SerializeFloat32(floats)
+}
+
+// InsertCommitEmbedding inserts or replaces a commit, its metadata and its
+// embedding vector.
+func InsertCommitEmbedding(db *sql.DB, info shared.CommitInfo, embedding []float64) error {
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, fmt.Errorf("failed to serialize query embedding: %v", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	rows, err := db.Query(`
-		SELECT commit_hash, vec_distance_cosine(embedding, ?) as distance
-		FROM commit_embeddings
-		ORDER BY distance ASC
-		LIMIT ?
-	`, blob, n)
+	if err := insertCommitEmbedding(tx, info, embedding); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertCommitEmbedding is InsertCommitEmbedding within tx, which must be a
+// transaction so the commits and commit_vectors rows stay consistent.
+func insertCommitEmbedding(tx execer, info shared.CommitInfo, embedding []float64) error {
+	blob, err := serializeFloat32(embedding)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query commit embeddings: %v", err)
+		return fmt.Errorf("failed to serialize commit embedding: %w", err)
+	}
+
+	var id int64
+	err = tx.QueryRow(`
+		INSERT INTO commits (commit_hash, author, committed_at, is_merge, subject)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (commit_hash) DO UPDATE SET
+			author = excluded.author,
+			committed_at = excluded.committed_at,
+			is_merge = excluded.is_merge,
+			subject = excluded.subject
+		RETURNING id
+	`, info.Hash, info.Author, info.Date.Unix(), info.Merge(), info.Subject).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("failed to insert commit: %w", err)
+	}
+
+	// vec0 tables do not support upserts
+	if _, err := tx.Exec("DELETE FROM commit_vectors WHERE rowid = ?", id); err != nil {
+		return fmt.Errorf("failed to delete commit embedding: %w", err)
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO commit_vectors (rowid, embedding, author, committed_at, is_merge) VALUES (?, ?, ?, ?, ?)",
+		id, blob, info.Author, info.Date.Unix(), info.Merge(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert commit embedding: %w", err)
 	}
+
+	return nil
+}
+
+func InsertFileEmbedding(db execer, filePath string, embedding []float64) error {
+	blob, err := serializeFloat32(embedding)
+	if err != nil {
+		return fmt.Errorf("failed to serialize file embedding: %w", err)
+	}
+
+	_, err = db.Exec(
+		"INSERT OR REPLACE INTO file_embeddings (file_path, embedding) VALUES (?, ?)",
+		filePath, blob,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert file embedding: %w", err)
+	}
+
+	return nil
+}
+
+func scanMatches(rows *sql.Rows) ([]shared.Match, error) {
 	defer rows.Close()
 
 	var results []shared.Match
@@ -135,13 +288,197 @@ func QueryCommitEmbeddings(db *sql.DB, embedding []float64, n int) ([]shared.Mat
 	return results, nil
 }
 
+// QueryCommitEmbeddings returns the n commits passing filter that are nearest
+// to embedding by cosine distance, using a KNN query on the vec0 table. The
+// filter is applied by vec0 during the search, so up to n commits are
+// returned however selective it is.
+func QueryCommitEmbeddings(db *sql.DB, embedding []float64, n int, filter store.Filter) ([]shared.Match, error) {
+	blob, err := serializeFloat32(embedding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize query embedding: %v", err)
+	}
+
+	constraints, filterArgs, ok, err := filterConstraints(db, filter, vectorColumns)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	args := append([]any{blob, n}, filterArgs...)
+
+	maxDistance := ""
+	if filter.MaxDistance > 0 {
+		maxDistance = "WHERE knn.distance <= ?"
+		args = append(args, filter.MaxDistance)
+	}
+
+	rows, err := db.Query(`
+		WITH knn AS (
+			SELECT rowid, distance
+			FROM commit_vectors
+			WHERE embedding MATCH ? AND k = ?`+constraints+`
+		)
+		SELECT c.commit_hash, knn.distance
+		FROM knn JOIN commits c ON c.id = knn.rowid
+		`+maxDistance+`
+		ORDER BY knn.distance ASC
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query commit embeddings: %v", err)
+	}
+
+	return scanMatches(rows)
+}
+
+// QueryCommitEmbeddingsBruteForce is like QueryCommitEmbeddings, but computes
+// the distance to every stored vector and sorts. It serves as the baseline
+// for benchmarking the KNN query.
+func QueryCommitEmbeddingsBruteForce(db *sql.DB, embedding []float64, n int) ([]shared.Match, error) {
+	blob, err := serializeFloat32(embedding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize query embedding: %v", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT c.commit_hash, vec_distance_cosine(v.embedding, ?) AS distance
+		FROM commit_vectors v JOIN commits c ON c.id = v.rowid
+		ORDER BY distance ASC
+		LIMIT ?
+	`, blob, n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query commit embeddings: %v", err)
+	}
+
+	return scanMatches(rows)
+}
+
+// CommitDistances returns the cosine distance between embedding and each of
+// the given commits that is indexed, keyed by commit hash.
+func CommitDistances(db *sql.DB, embedding []float64, commitHashes []string) (map[string]float64, error) {
+	distances := make(map[string]float64, len(commitHashes))
+	if len(commitHashes) == 0 {
+		return distances, nil
+	}
+
+	blob, err := serializeFloat32(embedding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize query embedding: %v", err)
+	}
+
+	args := []any{blob}
+	for _, commitHash := range commitHashes {
+		args = append(args, commitHash)
+	}
+
+	rows, err := db.Query(`
+		SELECT c.commit_hash, vec_distance_cosine(v.embedding, ?)
+		FROM commits c JOIN commit_vectors v ON v.rowid = c.id
+		WHERE c.commit_hash IN (?`+strings.Repeat(", ?", len(commitHashes)-1)+`)
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute commit distances: %v", err)
+	}
+
+	matches, err := scanMatches(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, match := range matches {
+		distances[match.CommitHash] = match.Distance
+	}
+
+	return distances, nil
+}
+
+func deserializeFloat32(blob []byte) ([]float64, error) {
+	if len(blob)%4 != 0 {
+		return nil, fmt.Errorf("invalid vector blob length: %d", len(blob))
+	}
+
+	vector := make([]float64, len(blob)/4)
+	for i := range vector {
+		vector[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(blob[i*4:])))
+	}
+
+	return vector, nil
+}
+
+func forEachEmbedding(db *sql.DB, query string, fn func(key string, embedding []float64) error) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var blob []byte
+		if err := rows.Scan(&key, &blob); err != nil {
+			return fmt.Errorf("failed to scan embedding: %v", err)
+		}
+
+		embedding, err := deserializeFloat32(blob)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(key, embedding); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ForEachCommitEmbedding calls fn for every stored commit embedding, in commit
+// hash order.
+func ForEachCommitEmbedding(db *sql.DB, fn func(commitHash string, embedding []float64) error) error {
+	return forEachEmbedding(db, `
+		SELECT c.commit_hash, v.embedding
+		FROM commits c JOIN commit_vectors v ON v.rowid = c.id
+		ORDER BY c.commit_hash
+	`, fn)
+}
+
+// ForEachFileEmbedding calls fn for every stored file embedding, in path
+// order.
+func ForEachFileEmbedding(db *sql.DB, fn func(filePath string, embedding []float64) error) error {
+	return forEachEmbedding(db, "SELECT file_path, embedding FROM file_embeddings ORDER BY file_path", fn)
+}
+
+// IndexedCommits returns the set of commits that have an embedding.
+func IndexedCommits(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query("SELECT c.commit_hash FROM commits c JOIN commit_vectors v ON v.rowid = c.id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list indexed commits: %w", err)
+	}
+	defer rows.Close()
+
+	commits := make(map[string]bool)
+	for rows.Next() {
+		var commitHash string
+		if err := rows.Scan(&commitHash); err != nil {
+			return nil, fmt.Errorf("failed to scan commit hash: %v", err)
+		}
+		commits[commitHash] = true
+	}
+
+	return commits, rows.Err()
+}
+
 // GetCommitEmbedding retrieves the embedding vector for a given commit hash.
+// It returns sql.ErrNoRows (wrapped) if the commit is not indexed.
 func GetCommitEmbedding(db *sql.DB, commitHash string) ([]float64, error) {
-	row := db.QueryRow("SELECT embedding FROM commit_embeddings WHERE commit_hash = ?", commitHash)
-	var embedding []float64
-	err := row.Scan(&embedding)
-	if err != nil {
+	row := db.QueryRow(`
+		SELECT v.embedding
+		FROM commits c JOIN commit_vectors v ON v.rowid = c.id
+		WHERE c.commit_hash = ?
+	`, commitHash)
+
+	var blob []byte
+	if err := row.Scan(&blob); err != nil {
 		return nil, fmt.Errorf("failed to get commit embedding: %w", err)
 	}
-	return embedding, nil
+
+	return deserializeFloat32(blob)
 }
@@ -0,0 +1,172 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/vasilisp/semblame/internal/shared"
+	"github.com/vasilisp/semblame/internal/store"
+)
+
+// testCommits are indexed by openTestStore, nearest to (1, 0, 0) first.
+var testCommits = []struct {
+	info      shared.CommitInfo
+	embedding []float64
+}{
+	{shared.CommitInfo{Hash: "aaaa", Author: "Alice <alice@example.com>", Date: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}, []float64{1, 0, 0}},
+	{shared.CommitInfo{Hash: "bbbb", Author: "Bob <bob@example.com>", Date: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), Parents: []string{"aaaa", "dddd"}}, []float64{1, 0.2, 0}},
+	{shared.CommitInfo{Hash: "cccc", Author: "Alice <alice@example.com>", Date: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}, []float64{1, 1, 0}},
+	{shared.CommitInfo{Hash: "dddd", Author: "Carol <carol@example.com>", Date: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)}, []float64{0, 0, 1}},
+}
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	s, err := OpenStore(context.Background(), filepath.Join(t.TempDir(), "index.sqlite"), shared.EmbeddingModel3Small, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	for _, commit := range testCommits {
+		if err := s.Upsert(commit.info, commit.embedding); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return s
+}
+
+func matchHashes(matches []shared.Match) []string {
+	hashes := make([]string, len(matches))
+	for i, match := range matches {
+		hashes[i] = match.CommitHash
+	}
+	return hashes
+}
+
+func TestQueryCommitEmbeddings(t *testing.T) {
+	s := openTestStore(t)
+
+	matches, err := s.Query([]float64{1, 0, 0}, 3, store.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := matchHashes(matches), []string{"aaaa", "bbbb", "cccc"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if matches[0].Distance > 1e-6 {
+		t.Errorf("distance to an identical vector: got %g, want 0", matches[0].Distance)
+	}
+
+	if !slices.IsSortedFunc(matches, func(a, b shared.Match) int {
+		return cmp.Compare(a.Distance, b.Distance)
+	}) {
+		t.Errorf("matches not sorted by distance: %v", matches)
+	}
+
+	// matches the brute-force baseline
+	baseline, err := QueryCommitEmbeddingsBruteForce(s.DB(), []float64{1, 0, 0}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := matchHashes(matches), matchHashes(baseline); !slices.Equal(got, want) {
+		t.Errorf("KNN got %v, brute force %v", got, want)
+	}
+}
+
+func TestUpsertReplacesEmbedding(t *testing.T) {
+	s := openTestStore(t)
+
+	info := testCommits[3].info
+	if err := s.Upsert(info, []float64{1, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Commits != len(testCommits) {
+		t.Errorf("got %d commits after upsert, want %d", stats.Commits, len(testCommits))
+	}
+
+	embedding, err := s.Get(info.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(embedding, []float64{1, 0, 0}) {
+		t.Errorf("got %v, want the new embedding", embedding)
+	}
+}
+
+func TestQueryCommitEmbeddingsFilter(t *testing.T) {
+	s := openTestStore(t)
+
+	tests := []struct {
+		name   string
+		filter store.Filter
+		want   []string
+	}{
+		{
+			name:   "author",
+			filter: store.Filter{Author: "alice"},
+			want:   []string{"aaaa", "cccc"},
+		},
+		{
+			name:   "unknown author",
+			filter: store.Filter{Author: "mallory"},
+			want:   []string{},
+		},
+		{
+			name: "dates",
+			filter: store.Filter{
+				Since: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+				Until: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			},
+			want: []string{"bbbb", "cccc"},
+		},
+		{
+			name:   "merges",
+			filter: store.Filter{ExcludeMerges: true},
+			want:   []string{"aaaa", "cccc", "dddd"},
+		},
+		{
+			name:   "commits",
+			filter: store.Filter{Commits: []string{"cccc", "dddd", "eeee"}},
+			want:   []string{"cccc", "dddd"},
+		},
+		{
+			name:   "no commits",
+			filter: store.Filter{Commits: []string{}},
+			want:   []string{},
+		},
+		{
+			name:   "distance",
+			filter: store.Filter{MaxDistance: 0.1},
+			want:   []string{"aaaa", "bbbb"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the filter is applied during the search, so a selective one
+			// still fills the limit
+			matches, err := s.Query([]float64{1, 0, 0}, max(len(tt.want), 1), tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := matchHashes(matches); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/vasilisp/semblame/internal/store"
+)
+
+// filterColumns names the columns a filter constrains, which differ between
+// the vec0 metadata columns and the commits table.
+type filterColumns struct {
+	id, author, committedAt, isMerge string
+}
+
+var (
+	vectorColumns = filterColumns{"rowid", "author", "committed_at", "is_merge"}
+	commitColumns = filterColumns{"c.id", "c.author", "c.committed_at", "c.is_merge"}
+)
+
+// matchingAuthors returns the distinct indexed authors matching the filter's
+// author pattern. vec0 can only compare metadata columns, so the pattern is
+// resolved here and passed to it as a list.
+func matchingAuthors(db *sql.DB, filter store.Filter) ([]string, error) {
+	re, err := filter.AuthorRegexp()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT DISTINCT author FROM commits")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list authors: %v", err)
+	}
+	defer rows.Close()
+
+	var authors []string
+	for rows.Next() {
+		var author string
+		if err := rows.Scan(&author); err != nil {
+			return nil, fmt.Errorf("failed to scan author: %v", err)
+		}
+		if re.MatchString(author) {
+			authors = append(authors, author)
+		}
+	}
+
+	return authors, rows.Err()
+}
+
+func placeholders(n int) string {
+	return "?" + strings.Repeat(", ?", n-1)
+}
+
+// filterConstraints translates filter into SQL constraints on the given
+// columns, each starting with AND. When the filter can match nothing (e.g. no
+// author matches), ok is false.
+func filterConstraints(db *sql.DB, filter store.Filter, columns filterColumns) (where string, args []any, ok bool, err error) {
+	var b strings.Builder
+
+	if filter.Author != "" {
+		authors, err := matchingAuthors(db, filter)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if len(authors) == 0 {
+			return "", nil, false, nil
+		}
+
+		fmt.Fprintf(&b, " AND %s IN (%s)", columns.author, placeholders(len(authors)))
+		for _, author := range authors {
+			args = append(args, author)
+		}
+	}
+	if !filter.Since.IsZero() {
+		fmt.Fprintf(&b, " AND %s >= ?", columns.committedAt)
+		args = append(args, filter.Since.Unix())
+	}
+	if !filter.Until.IsZero() {
+		fmt.Fprintf(&b, " AND %s <= ?", columns.committedAt)
+		args = append(args, filter.Until.Unix())
+	}
+	if filter.ExcludeMerges {
+		fmt.Fprintf(&b, " AND %s = 0", columns.isMerge)
+	}
+	if filter.Commits != nil {
+		if len(filter.Commits) == 0 {
+			return "", nil, false, nil
+		}
+
+		// a single JSON parameter, as the set may exceed SQLite's limit on
+		// the number of parameters
+		commits, err := json.Marshal(filter.Commits)
+		if err != nil {
+			return "", nil, false, err
+		}
+
+		fmt.Fprintf(&b, " AND %s IN (SELECT f.id FROM commits f JOIN json_each(?) j ON j.value = f.commit_hash)", columns.id)
+		args = append(args, string(commits))
+	}
+
+	return b.String(), args, true, nil
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/vasilisp/semblame/internal/store"
+)
+
+// The lexical index is an FTS4 table keyed by commits.id. Unlike FTS5, FTS4 is
+// compiled into go-sqlite3 without build tags, but it has no ranking
+// function: matches are ranked by BM25 here, from matchinfo.
+const createCommitTextTableSQL = `
+CREATE VIRTUAL TABLE commit_fts USING fts4(
+    message,
+    diff,
+    tokenize=unicode61
+);
+`
+
+// HasLexicalIndex reports whether the database has a full-text index over
+// commit messages and diffs, which databases migrated to schema version 3 or
+// later do.
+func HasLexicalIndex(db queryRower) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name = 'commit_fts'").Scan(&n)
+	return n > 0, err
+}
+
+// IndexCommitText adds the message and diff of an already inserted commit to
+// the lexical index, replacing any previous entry.
+func IndexCommitText(db execer, commitHash, message, diff string) error {
+	var id int64
+	if err := db.QueryRow("SELECT id FROM commits WHERE commit_hash = ?", commitHash).Scan(&id); err != nil {
+		return fmt.Errorf("failed to get commit id: %w", err)
+	}
+
+	if _, err := db.Exec("DELETE FROM commit_fts WHERE rowid = ?", id); err != nil {
+		return fmt.Errorf("failed to delete commit text: %v", err)
+	}
+
+	if _, err := db.Exec("INSERT INTO commit_fts (rowid, message, diff) VALUES (?, ?, ?)", id, message, diff); err != nil {
+		return fmt.Errorf("failed to insert commit text: %v", err)
+	}
+
+	return nil
+}
+
+var ftsToken = regexp.MustCompile(`[\p{L}\p{N}_]+`)
+
+// ftsQuery turns free text into an FTS query matching any of its words, so
+// that punctuation in the question cannot produce a syntax error.
+func ftsQuery(query string) string {
+	tokens := ftsToken.FindAllString(query, -1)
+	for i, token := range tokens {
+		tokens[i] = `"` + token + `"`
+	}
+	return strings.Join(tokens, " OR ")
+}
+
+// BM25 parameters, as in FTS5.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// bm25 returns the BM25 score of a row, higher being better, from its
+// matchinfo with format 'pcnalx': the numbers of phrases p, columns c and
+// rows n, the average number of tokens in each column, the number of tokens
+// in each column of the row, and for every phrase and column, the hits in the
+// row, the hits in all rows and the number of rows with hits.
+func bm25(matchinfo []byte) (float64, error) {
+	if len(matchinfo)%4 != 0 {
+		return 0, fmt.Errorf("invalid matchinfo of %d bytes", len(matchinfo))
+	}
+
+	info := make([]uint32, len(matchinfo)/4)
+	for i := range info {
+		info[i] = binary.NativeEndian.Uint32(matchinfo[4*i:])
+	}
+
+	if len(info) < 3 {
+		return 0, fmt.Errorf("invalid matchinfo of %d values", len(info))
+	}
+
+	p, c, n := int(info[0]), int(info[1]), float64(info[2])
+	if len(info) != 3+2*c+3*p*c {
+		return 0, fmt.Errorf("invalid matchinfo of %d values for %d phrases and %d columns", len(info), p, c)
+	}
+
+	averages := info[3 : 3+c]
+	lengths := info[3+c : 3+2*c]
+	hits := info[3+2*c:]
+
+	score := 0.0
+	for i := range p {
+		for j := range c {
+			x := hits[3*(i*c+j):]
+			tf, df := float64(x[0]), float64(x[2])
+			if tf == 0 {
+				continue
+			}
+
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			norm := 1.0
+			if averages[j] > 0 {
+				norm = 1 - bm25B + bm25B*float64(lengths[j])/float64(averages[j])
+			}
+
+			score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+
+	return score, nil
+}
+
+// QueryCommitText returns the hashes of up to n commits passing filter whose
+// message or diff match words of the query, best BM25 score first.
+func QueryCommitText(db *sql.DB, query string, n int, filter store.Filter) ([]string, error) {
+	match := ftsQuery(query)
+	if match == "" {
+		return nil, nil
+	}
+
+	constraints, filterArgs, ok, err := filterConstraints(db, filter, commitColumns)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	args := append([]any{match}, filterArgs...)
+
+	rows, err := db.Query(`
+		SELECT c.commit_hash, matchinfo(commit_fts, 'pcnalx')
+		FROM commit_fts JOIN commits c ON c.id = commit_fts.rowid
+		WHERE commit_fts MATCH ?`+constraints, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query commit text: %v", err)
+	}
+	defer rows.Close()
+
+	type scored struct {
+		commitHash string
+		score      float64
+	}
+
+	var matches []scored
+	for rows.Next() {
+		var commitHash string
+		var matchinfo []byte
+		if err := rows.Scan(&commitHash, &matchinfo); err != nil {
+			return nil, fmt.Errorf("failed to scan query result: %v", err)
+		}
+
+		score, err := bm25(matchinfo)
+		if err != nil {
+			return nil, err
+		}
+
+		matches = append(matches, scored{commitHash, score})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.SortStableFunc(matches, func(a, b scored) int {
+		return cmp.Compare(b.score, a.score)
+	})
+
+	hashes := make([]string, min(n, len(matches)))
+	for i := range hashes {
+		hashes[i] = matches[i].commitHash
+	}
+
+	return hashes, nil
+}
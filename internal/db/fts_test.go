@@ -0,0 +1,73 @@
+package db
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/vasilisp/semblame/internal/store"
+)
+
+func TestQueryCommitText(t *testing.T) {
+	s := openTestStore(t)
+
+	texts := map[string][2]string{
+		"aaaa": {"Retry uploads on timeout", "+retries := 3"},
+		"bbbb": {"Fix typo in README", "-teh\n+the"},
+		"cccc": {"Document upload limits", "+Uploads are capped at 10 MiB."},
+		"dddd": {"Retry, retry: back off exponentially between retries", "+backoff *= 2"},
+	}
+	for commitHash, text := range texts {
+		if err := s.IndexText(commitHash, text[0], text[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		filter store.Filter
+		want   []string
+		// unordered is set when only the set of matches is checked
+		unordered bool
+	}{
+		{
+			name:  "more hits rank first",
+			query: "retry",
+			want:  []string{"dddd", "aaaa"},
+		},
+		{
+			name:      "any word",
+			query:     "typo? uploads!",
+			want:      []string{"aaaa", "bbbb", "cccc"},
+			unordered: true,
+		},
+		{
+			name:   "filtered",
+			query:  "retry",
+			filter: store.Filter{Author: "alice"},
+			want:   []string{"aaaa"},
+		},
+		{
+			name:  "punctuation only",
+			query: "?!",
+			want:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.QueryText(tt.query, 10, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.unordered {
+				slices.Sort(got)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/vasilisp/semblame/internal/shared"
+)
+
+// migrationParams carries the index configuration that some migrations need,
+// e.g. to size vector columns.
+type migrationParams struct {
+	model      shared.EmbeddingModel
+	dimensions uint32
+}
+
+// migrations lists the schema changes in order: migrations[i] upgrades a
+// database from version i to version i+1. Existing entries must never be
+// edited or reordered; schema changes are made by appending a new one.
+var migrations = []func(tx *sql.Tx, params migrationParams) error{
+	migrateInitial,
+	migrateVec0,
+	migrateCommitText,
+}
+
+// LatestSchemaVersion is the schema version this binary creates and
+// understands.
+var LatestSchemaVersion = len(migrations)
+
+const createSchemaVersionTableSQL = `
+CREATE TABLE IF NOT EXISTS schema_version (
+    version INTEGER NOT NULL
+);
+`
+
+// migrateInitial creates the tables of the original, unversioned schema.
+// Databases created before versioning already have them, hence IF NOT EXISTS.
+func migrateInitial(tx *sql.Tx, _ migrationParams) error {
+	if _, err := tx.Exec(createCommitsTableSQL); err != nil {
+		return fmt.Errorf("failed to create commit_embeddings table: %v", err)
+	}
+
+	if _, err := tx.Exec(createFilesTableSQL); err != nil {
+		return fmt.Errorf("failed to create file_embeddings table: %v", err)
+	}
+
+	return nil
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	queryRower
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+const createCommitsMetadataTableSQL = `
+CREATE TABLE commits (
+    id INTEGER PRIMARY KEY,
+    commit_hash TEXT NOT NULL UNIQUE,
+    author TEXT NOT NULL DEFAULT '',
+    committed_at INTEGER NOT NULL DEFAULT 0,
+    is_merge INTEGER NOT NULL DEFAULT 0,
+    subject TEXT NOT NULL DEFAULT ''
+);
+`
+
+// The vec0 table is keyed by commits.id. The metadata columns duplicate
+// those of commits so that KNN queries can filter on them.
+const createCommitVectorsTableSQL = `
+CREATE VIRTUAL TABLE commit_vectors USING vec0(
+    embedding float[%d] distance_metric=cosine,
+    author text,
+    committed_at integer,
+    is_merge boolean
+);
+`
+
+const createSettingsTableSQL = `
+CREATE TABLE settings (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL
+);
+`
+
+// migrateVec0 moves commit embeddings from the plain commit_embeddings table
+// into a sqlite-vec vec0 table, so that queries use KNN instead of computing
+// every distance. Since vec0 columns have fixed dimensions, the model and
+// dimensions the index is built for are recorded in settings.
+func migrateVec0(tx *sql.Tx, params migrationParams) error {
+	if _, err := tx.Exec(createCommitsMetadataTableSQL); err != nil {
+		return fmt.Errorf("failed to create commits table: %v", err)
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf(createCommitVectorsTableSQL, params.dimensions)); err != nil {
+		return fmt.Errorf("failed to create commit_vectors table: %v", err)
+	}
+
+	if _, err := tx.Exec(createSettingsTableSQL); err != nil {
+		return fmt.Errorf("failed to create settings table: %v", err)
+	}
+
+	_, err := tx.Exec(
+		"INSERT INTO settings (key, value) VALUES ('model', ?), ('dimensions', ?)",
+		params.model.String(), params.dimensions,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record settings: %v", err)
+	}
+
+	// metadata is filled in the next time the commits are ingested
+	_, err = tx.Exec(`
+		INSERT INTO commits (commit_hash)
+		SELECT commit_hash FROM commit_embeddings
+		WHERE vec_length(embedding) = ?
+	`, params.dimensions)
+	if err != nil {
+		return fmt.Errorf("failed to copy commits: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO commit_vectors (rowid, embedding, author, committed_at, is_merge)
+		SELECT c.id, e.embedding, '', 0, 0
+		FROM commits c JOIN commit_embeddings e ON e.commit_hash = c.commit_hash
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to copy commit embeddings: %v", err)
+	}
+
+	if _, err := tx.Exec("DROP TABLE commit_embeddings"); err != nil {
+		return fmt.Errorf("failed to drop commit_embeddings table: %v", err)
+	}
+
+	return nil
+}
+
+// migrateCommitText creates the lexical index. Commits already indexed are
+// added to it the next time they are ingested. Binaries built with the
+// sqlite_fts5 tag used to keep an FTS5 index, commit_text, outside the
+// versioned schema; it is dropped if this binary can, and otherwise left
+// unused.
+func migrateCommitText(tx *sql.Tx, _ migrationParams) error {
+	if _, err := tx.Exec(createCommitTextTableSQL); err != nil {
+		return fmt.Errorf("failed to create commit_fts table: %v", err)
+	}
+
+	var legacy int
+	err := tx.QueryRow("SELECT count(*) FROM sqlite_master WHERE name = 'commit_text'").Scan(&legacy)
+	if err != nil {
+		return err
+	}
+
+	var fts5 bool
+	if err := tx.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		return err
+	}
+
+	if legacy > 0 && fts5 {
+		if _, err := tx.Exec("DROP TABLE commit_text"); err != nil {
+			return fmt.Errorf("failed to drop commit_text table: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func schemaVersion(q queryRower) (int, error) {
+	var version int
+	err := q.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// SchemaVersion returns the schema version of the database, 0 if it predates
+// versioning.
+func SchemaVersion(db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name = 'schema_version'").Scan(&n)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	return schemaVersion(db)
+}
+
+// checkVersion returns shared.ErrSchemaTooNew if version is newer than this
+// binary understands.
+func checkVersion(version int) error {
+	if version > LatestSchemaVersion {
+		return fmt.Errorf("%w: version %d, newest supported is %d; upgrade semblame", shared.ErrSchemaTooNew, version, LatestSchemaVersion)
+	}
+
+	return nil
+}
+
+// Migrate upgrades the database to LatestSchemaVersion in a single
+// transaction. It refuses to touch a database whose schema is newer than this
+// binary understands, returning shared.ErrSchemaTooNew. The model and
+// dimensions are used by migrations that create vector tables. The version is
+// read outside any transaction first, so that opening an up-to-date database
+// does not wait for the write lock, e.g. while an ingest holds it.
+func Migrate(db *sql.DB, model shared.EmbeddingModel, dimensions uint32) error {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("failed to get schema version: %v", err)
+	}
+
+	if err := checkVersion(version); err != nil {
+		return err
+	}
+
+	if version == LatestSchemaVersion {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(createSchemaVersionTableSQL); err != nil {
+		return fmt.Errorf("failed to create schema_version table: %v", err)
+	}
+
+	// read again under the write lock, in case another process migrated the
+	// database in the meantime
+	version, err = schemaVersion(tx)
+	if err != nil {
+		return fmt.Errorf("failed to get schema version: %v", err)
+	}
+
+	if err := checkVersion(version); err != nil {
+		return err
+	}
+
+	if version == LatestSchemaVersion {
+		return tx.Commit()
+	}
+
+	for i := version; i < LatestSchemaVersion; i++ {
+		if err := migrations[i](tx, migrationParams{model: model, dimensions: dimensions}); err != nil {
+			return fmt.Errorf("migration to schema version %d failed: %w", i+1, err)
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM schema_version"); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("INSERT INTO schema_version (version) VALUES (?)", LatestSchemaVersion); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
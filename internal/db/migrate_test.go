@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	sqlite_vec "github.com/asg017/sqlite-vec-go-bindings/cgo"
+	"github.com/vasilisp/semblame/internal/shared"
+	"github.com/vasilisp/semblame/internal/store"
+)
+
+// createV0 creates a database with the original, unversioned schema at path.
+func createV0(t *testing.T, path string, commits map[string][]float64, files map[string][]float64) {
+	t.Helper()
+
+	sqlite_vec.Auto()
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, stmt := range []string{createCommitsTableSQL, createFilesTableSQL} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for commitHash, embedding := range commits {
+		blob, err := serializeFloat32(embedding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO commit_embeddings (commit_hash, embedding) VALUES (?, ?)", commitHash, blob); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for filePath, embedding := range files {
+		if err := InsertFileEmbedding(db, filePath, embedding); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrateFromV0(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.sqlite")
+
+	createV0(t, path, map[string][]float64{
+		"aaaa": {1, 0, 0},
+		"bbbb": {0, 1, 0},
+		// embedded with other dimensions, so it cannot be moved to vec0
+		"cccc": {1, 0, 0, 0},
+	}, map[string][]float64{
+		"main.go": {0, 0, 1},
+	})
+
+	s, err := OpenStore(context.Background(), path, shared.EmbeddingModel3Small, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := SchemaVersion(s.DB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != LatestSchemaVersion {
+		t.Errorf("schema version: got %d, want %d", version, LatestSchemaVersion)
+	}
+
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Commits != 2 || stats.Files != 1 {
+		t.Errorf("got %d commits and %d files, want 2 and 1", stats.Commits, stats.Files)
+	}
+
+	if _, err := s.Get("cccc"); err == nil {
+		t.Error("embedding with other dimensions was migrated")
+	}
+
+	matches, err := s.Query([]float64{0, 1, 0}, 1, store.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].CommitHash != "bbbb" {
+		t.Errorf("nearest to bbbb: got %v", matches)
+	}
+
+	hasText, err := s.HasTextIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasText {
+		t.Error("no lexical index after migration")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the database is now built for the model and dimensions it was opened
+	// with
+	_, err = OpenStore(context.Background(), path, shared.EmbeddingModel3Small, 4)
+	if !errors.Is(err, shared.ErrDimensionMismatch) {
+		t.Errorf("opening with other dimensions: got %v, want %v", err, shared.ErrDimensionMismatch)
+	}
+}
+
+func TestMigrateTooNew(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.sqlite")
+
+	s, err := OpenStore(context.Background(), path, shared.EmbeddingModel3Small, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.DB().Exec("UPDATE schema_version SET version = ?", LatestSchemaVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	_, err = OpenStore(context.Background(), path, shared.EmbeddingModel3Small, 3)
+	if !errors.Is(err, shared.ErrSchemaTooNew) {
+		t.Errorf("got %v, want %v", err, shared.ErrSchemaTooNew)
+	}
+}
@@ -0,0 +1,229 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vasilisp/semblame/internal/shared"
+	"github.com/vasilisp/semblame/internal/store"
+)
+
+// Store is the SQLite implementation of store.VectorStore, backed by a vec0
+// table for KNN queries and, when available, an FTS5 table for full-text
+// queries.
+type Store struct {
+	db *sql.DB
+	// tx, if set, is the batch transaction writes go through.
+	tx *sql.Tx
+}
+
+var (
+	_ store.VectorStore = (*Store)(nil)
+	_ store.TextIndex   = (*Store)(nil)
+	_ store.Batcher     = (*Store)(nil)
+)
+
+// OpenStore opens the database at path as with Open.
+func OpenStore(ctx context.Context, path string, model shared.EmbeddingModel, dimensions uint32) (*Store, error) {
+	db, err := Open(ctx, path, model, dimensions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+// OpenStoreReadOnly opens the database at path as with OpenReadOnly. The
+// database must be at the latest schema version for the store to work.
+func OpenStoreReadOnly(path string) (*Store, error) {
+	db, err := OpenReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+// DB returns the underlying database handle, for operations the VectorStore
+// interface does not cover.
+func (s *Store) DB() *sql.DB {
+	return s.db
+}
+
+// writer returns the handle writes go through.
+func (s *Store) writer() execer {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+func (s *Store) BeginBatch() error {
+	if s.tx != nil {
+		return fmt.Errorf("batch already in progress")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	s.tx = tx
+	return nil
+}
+
+func (s *Store) EndBatch(commit bool) error {
+	if s.tx == nil {
+		return nil
+	}
+
+	tx := s.tx
+	s.tx = nil
+
+	if !commit {
+		return tx.Rollback()
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) Upsert(info shared.CommitInfo, embedding []float64) error {
+	if s.tx != nil {
+		return insertCommitEmbedding(s.tx, info, embedding)
+	}
+
+	return InsertCommitEmbedding(s.db, info, embedding)
+}
+
+func (s *Store) UpsertFile(filePath string, embedding []float64) error {
+	return InsertFileEmbedding(s.writer(), filePath, embedding)
+}
+
+func (s *Store) Delete(commitHash string) error {
+	if s.tx != nil {
+		return deleteCommit(s.tx, commitHash)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := deleteCommit(tx, commitHash); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func deleteCommit(tx execer, commitHash string) error {
+	var id int64
+	err := tx.QueryRow("DELETE FROM commits WHERE commit_hash = ? RETURNING id", commitHash).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete commit: %w", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM commit_vectors WHERE rowid = ?", id); err != nil {
+		return fmt.Errorf("failed to delete commit embedding: %w", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM commit_fts WHERE rowid = ?", id); err != nil {
+		return fmt.Errorf("failed to delete commit text: %w", err)
+	}
+
+	return nil
+}
+
+// Clear deletes every commit and file embedding, along with the lexical
+// index.
+func (s *Store) Clear() error {
+	w := s.writer()
+
+	for _, table := range []string{"commits", "commit_vectors", "commit_fts", "file_embeddings"} {
+		if _, err := w.Exec("DELETE FROM " + table); err != nil {
+			return fmt.Errorf("failed to clear %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) Get(commitHash string) ([]float64, error) {
+	embedding, err := GetCommitEmbedding(s.db, commitHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", store.ErrNotFound, commitHash)
+	}
+
+	return embedding, err
+}
+
+func (s *Store) Query(embedding []float64, n int, filter store.Filter) ([]shared.Match, error) {
+	return QueryCommitEmbeddings(s.db, embedding, n, filter)
+}
+
+func (s *Store) Distances(embedding []float64, commitHashes []string) (map[string]float64, error) {
+	return CommitDistances(s.db, embedding, commitHashes)
+}
+
+func (s *Store) ForEach(fn func(commitHash string, embedding []float64) error) error {
+	return ForEachCommitEmbedding(s.db, fn)
+}
+
+func (s *Store) ForEachFile(fn func(filePath string, embedding []float64) error) error {
+	return ForEachFileEmbedding(s.db, fn)
+}
+
+func (s *Store) Stats() (store.Stats, error) {
+	var stats store.Stats
+	var oldest, newest sql.NullInt64
+
+	err := s.db.QueryRow(`
+		SELECT count(*), min(nullif(c.committed_at, 0)), max(nullif(c.committed_at, 0))
+		FROM commits c JOIN commit_vectors v ON v.rowid = c.id
+	`).Scan(&stats.Commits, &oldest, &newest)
+	if err != nil {
+		return stats, fmt.Errorf("failed to count commits: %w", err)
+	}
+
+	if oldest.Valid {
+		stats.Oldest = time.Unix(oldest.Int64, 0)
+		stats.Newest = time.Unix(newest.Int64, 0)
+	}
+
+	if err := s.db.QueryRow("SELECT count(*) FROM file_embeddings").Scan(&stats.Files); err != nil {
+		return stats, fmt.Errorf("failed to count files: %w", err)
+	}
+
+	return stats, nil
+}
+
+func (s *Store) Close() error {
+	if err := s.EndBatch(false); err != nil {
+		return err
+	}
+
+	return s.db.Close()
+}
+
+func (s *Store) HasTextIndex() (bool, error) {
+	return HasLexicalIndex(s.writer())
+}
+
+func (s *Store) IndexText(commitHash, message, diff string) error {
+	return IndexCommitText(s.writer(), commitHash, message, diff)
+}
+
+func (s *Store) QueryText(query string, n int, filter store.Filter) ([]string, error) {
+	return QueryCommitText(s.db, query, n, filter)
+}
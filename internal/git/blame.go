@@ -0,0 +1,152 @@
+package git
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// uncommitted reports whether commitHash is the all-zero hash git blame
+// reports for lines not yet committed, in SHA-1 or SHA-256 repositories.
+func uncommitted(commitHash string) bool {
+	return strings.Trim(commitHash, "0") == ""
+}
+
+// LineRange is a 1-based, inclusive range of lines in a file.
+type LineRange struct {
+	File  string
+	Start int
+	End   int
+}
+
+// ParseLineRange parses "<file>:<line>" or "<file>:<start>-<end>".
+func ParseLineRange(s string) (LineRange, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return LineRange{}, fmt.Errorf("expected <file>:<line>[-<end>], got %q", s)
+	}
+
+	r := LineRange{File: s[:i]}
+	start, end, isRange := strings.Cut(s[i+1:], "-")
+
+	var err error
+	if r.Start, err = strconv.Atoi(start); err != nil || r.Start < 1 {
+		return LineRange{}, fmt.Errorf("invalid line %q", start)
+	}
+
+	r.End = r.Start
+	if isRange {
+		if r.End, err = strconv.Atoi(end); err != nil || r.End < r.Start {
+			return LineRange{}, fmt.Errorf("invalid end line %q", end)
+		}
+	}
+
+	return r, nil
+}
+
+func (r LineRange) String() string {
+	if r.Start == r.End {
+		return fmt.Sprintf("%s:%d", r.File, r.Start)
+	}
+	return fmt.Sprintf("%s:%d-%d", r.File, r.Start, r.End)
+}
+
+// BlameResult is the outcome of blaming a range of lines.
+type BlameResult struct {
+	// Commits are the commits that last touched the lines, in order of first
+	// appearance. Uncommitted changes are left out.
+	Commits []string
+	// Lines are the contents of the lines.
+	Lines []string
+}
+
+// Blame runs `git blame --porcelain -w -M -C` on the given lines of HEAD, so
+// that whitespace changes and moved or copied code are attributed to the
+// commits that wrote it. Line numbers refer to HEAD, as with LineHistory, not
+// to the work tree.
+func Blame(ctx context.Context, repoPath string, r LineRange) (BlameResult, error) {
+	var result BlameResult
+
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "blame", "--porcelain", "-w", "-M", "-C",
+		"-L", fmt.Sprintf("%d,%d", r.Start, r.End), "HEAD", "--", r.File)
+
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return result, fmt.Errorf("git blame %s: %s", r, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return result, err
+	}
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	scanner.Buffer(nil, 1<<20)
+
+	// each line is a header (<hash> <orig> <final> [<count>]), metadata the
+	// first time a commit appears, and the content prefixed with a tab
+	header := true
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "\t") {
+			result.Lines = append(result.Lines, line[1:])
+			header = true
+			continue
+		}
+
+		if !header {
+			continue
+		}
+		header = false
+
+		commitHash, _, _ := strings.Cut(line, " ")
+		if !uncommitted(commitHash) && !seen[commitHash] {
+			seen[commitHash] = true
+			result.Commits = append(result.Commits, commitHash)
+		}
+	}
+
+	return result, scanner.Err()
+}
+
+// BlameText returns the output of `git blame -w -M -C` on the given lines as
+// of rev (HEAD if empty), one line per source line prefixed with the full
+// hash, author and date of the commit that last touched it.
+func BlameText(ctx context.Context, repoPath, rev string, r LineRange) (string, error) {
+	if rev == "" {
+		rev = "HEAD"
+	}
+
+	args := []string{"-C", repoPath, "blame", "-l", "-w", "-M", "-C", "--date=short",
+		"-L", fmt.Sprintf("%d,%d", r.Start, r.End), rev, "--", r.File}
+
+	out, err := exec.CommandContext(ctx, "git", args...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("git blame %s: %s", r, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+// LineHistory returns up to n commits, newest first, that changed the given
+// lines or the code they evolved from, as tracked by `git log -L`.
+func LineHistory(ctx context.Context, repoPath string, r LineRange, n int) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "log", "--format=%H", "-s", "-n", strconv.Itoa(n),
+		"-L", fmt.Sprintf("%d,%d:%s", r.Start, r.End, r.File))
+
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("git log -L %s: %s", r, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+
+	return strings.Fields(string(out)), nil
+}
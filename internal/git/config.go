@@ -2,8 +2,11 @@ package git
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -33,7 +36,37 @@ func configGet(ctx context.Context, repoPath, key string) (string, error) {
 	return strings.TrimSpace(string(out)), nil
 }
 
+// configGetAll returns all values of a multi-valued key, or nil if the key is
+// not set.
+func configGetAll(ctx context.Context, repoPath, key string) ([]string, error) {
+	key = "semblame." + key
+	cmdGet := exec.CommandContext(ctx, "git", "-C", repoPath, "config", "--get-all", key)
+
+	out, err := cmdGet.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return strings.Split(strings.TrimSpace(string(out)), "\n"), nil
+}
+
+// readOnlyKey marks a context under which configuration is read without
+// writing defaults or a new UUID; see ReadConfig.
+type readOnlyKey struct{}
+
+func readOnly(ctx context.Context) bool {
+	return ctx.Value(readOnlyKey{}) != nil
+}
+
 func configSet(ctx context.Context, repoPath, key, value string) error {
+	if readOnly(ctx) {
+		return nil
+	}
+
 	key = "semblame." + key
 	cmdSet := exec.CommandContext(ctx, "git", "-C", repoPath, "config", key, value)
 	return cmdSet.Run()
@@ -89,22 +122,48 @@ func uint32Converter() stringConverter[uint32] {
 	}
 }
 
-func EmbeddingDimensions(ctx context.Context, repoPath string) uint32 {
+// ErrNotARepository is returned when the given path is not inside a Git
+// repository.
+var ErrNotARepository = errors.New("not a git repository")
+
+// CheckRepository returns ErrNotARepository (wrapped) if repoPath is not inside
+// a Git work tree.
+func CheckRepository(ctx context.Context, repoPath string) error {
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "rev-parse", "--git-dir")
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("%w: %s", ErrNotARepository, repoPath)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func EmbeddingDimensions(ctx context.Context, repoPath string) (uint32, error) {
 	d, err := ConfigGetWithDefault(ctx, repoPath, "dimensions", uint32Converter(), 512)
+	var numErr *strconv.NumError
+	if errors.As(err, &numErr) {
+		return 0, fmt.Errorf("%w: semblame.dimensions %q is not a positive integer", shared.ErrInvalidDimensions, numErr.Num)
+	}
 	if err != nil {
-		log.Fatalf("failed to get embedding dimensions: %v", err)
+		return 0, fmt.Errorf("failed to get embedding dimensions: %w", err)
+	}
+
+	if d == 0 {
+		return 0, fmt.Errorf("%w: semblame.dimensions must be positive", shared.ErrInvalidDimensions)
 	}
 
-	return d
+	return d, nil
 }
 
-func EmbeddingModel(ctx context.Context, repoPath string) string {
+func EmbeddingModel(ctx context.Context, repoPath string) (shared.EmbeddingModel, error) {
 	m, err := ConfigGetWithDefaultString(ctx, repoPath, "model", "text-embedding-3-small")
 	if err != nil {
-		log.Fatalf("failed to get embedding model: %v", err)
+		return 0, fmt.Errorf("failed to get embedding model: %w", err)
 	}
 
-	return m
+	return shared.EmbeddingModelFromString(m)
 }
 
 func boolConverter() stringConverter[bool] {
@@ -114,57 +173,373 @@ func boolConverter() stringConverter[bool] {
 	}
 }
 
-func WriteNotes(ctx context.Context, repoPath string) bool {
+func WriteNotes(ctx context.Context, repoPath string) (bool, error) {
 	b, err := ConfigGetWithDefault(ctx, repoPath, "write-notes", boolConverter(), true)
 	if err != nil {
-		log.Fatalf("failed to get write-notes: %v", err)
+		return false, fmt.Errorf("failed to get write-notes: %w", err)
+	}
+
+	return b, nil
+}
+
+func float64Converter() stringConverter[float64] {
+	return stringConverter[float64]{
+		toString:   func(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) },
+		fromString: func(s string) (float64, error) { return strconv.ParseFloat(s, 64) },
+	}
+}
+
+// LexicalWeight returns the weight, between 0 and 1, of the full-text ranking
+// when it is fused with the semantic one. 0 disables lexical retrieval and 1
+// ranks by full-text matches alone.
+func LexicalWeight(ctx context.Context, repoPath string) (float64, error) {
+	w, err := ConfigGetWithDefault(ctx, repoPath, "lexicalWeight", float64Converter(), 0.5)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get lexicalWeight: %w", err)
+	}
+
+	if w < 0 || w > 1 {
+		return 0, fmt.Errorf("lexicalWeight must be between 0 and 1, got %g", w)
+	}
+
+	return w, nil
+}
+
+// PromptBudget returns the maximum number of tokens of commits put into a
+// prompt for the chat model.
+func PromptBudget(ctx context.Context, repoPath string) (int, error) {
+	b, err := ConfigGetWithDefault(ctx, repoPath, "promptBudget", uint32Converter(), 100000)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get promptBudget: %w", err)
+	}
+
+	if b == 0 {
+		return 0, fmt.Errorf("promptBudget must be positive")
+	}
+
+	return int(b), nil
+}
+
+// ChatConfig holds the settings of the chat model that explains commits.
+type ChatConfig struct {
+	// Model is the name of the chat model.
+	Model string
+	// BaseURL is the URL of an OpenAI-compatible API to use instead of
+	// OpenAI's, if set.
+	BaseURL string
+	// Temperature is the sampling temperature, or nil for the model's
+	// default.
+	Temperature *float64
+	// PromptBudget is the maximum number of tokens of commits in a prompt.
+	PromptBudget int
+	// PromptFile is the path of the repository's system prompt template, or
+	// empty for the default prompt.
+	PromptFile string
+	// ToolSteps is the number of rounds of tool calls the model may make
+	// before answering; 0 disables tools.
+	ToolSteps int
+}
+
+// TopLevel returns the absolute path of the top of the work tree, or an empty
+// path for a bare repository.
+func TopLevel(ctx context.Context, repoPath string) (string, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", repoPath, "rev-parse", "--is-bare-repository").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to check for a work tree: %w", err)
+	}
+
+	if strings.TrimSpace(string(out)) == "true" {
+		return "", nil
+	}
+
+	out, err = exec.CommandContext(ctx, "git", "-C", repoPath, "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get work tree: %w", err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// repoPromptFile is where a repository keeps its system prompt template,
+// relative to the top of the work tree, unless semblame.promptFile says
+// otherwise.
+const repoPromptFile = ".semblame/prompt.md"
+
+// PromptFile returns the path of the system prompt template given by
+// semblame.promptFile (relative paths are relative to repoPath), or else of
+// .semblame/prompt.md at the top of the work tree if it exists. It returns
+// an empty path if there is neither.
+func PromptFile(ctx context.Context, repoPath string) (string, error) {
+	path, err := configGet(ctx, repoPath, "promptFile")
+	if err != nil {
+		return "", fmt.Errorf("failed to get promptFile: %w", err)
+	}
+
+	if path != "" {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(repoPath, path)
+		}
+		return path, nil
+	}
+
+	top, err := TopLevel(ctx, repoPath)
+	if err != nil {
+		return "", err
+	}
+	if top == "" {
+		return "", nil
+	}
+
+	path = filepath.Join(top, repoPromptFile)
+	if _, err := os.Stat(path); err != nil {
+		return "", nil
+	}
+
+	return path, nil
+}
+
+// Chat reads the chat model settings: semblame.chatModel (default
+// gpt-4.1-mini), semblame.chatBaseURL, semblame.temperature (between 0 and 2),
+// semblame.promptBudget, semblame.toolSteps (default 5) and the prompt file
+// (see PromptFile).
+func Chat(ctx context.Context, repoPath string) (ChatConfig, error) {
+	var config ChatConfig
+	var err error
+
+	if config.Model, err = ConfigGetWithDefaultString(ctx, repoPath, "chatModel", "gpt-4.1-mini"); err != nil {
+		return config, fmt.Errorf("failed to get chatModel: %w", err)
+	}
+
+	if config.BaseURL, err = configGet(ctx, repoPath, "chatBaseURL"); err != nil {
+		return config, fmt.Errorf("failed to get chatBaseURL: %w", err)
+	}
+
+	temperature, err := configGet(ctx, repoPath, "temperature")
+	if err != nil {
+		return config, fmt.Errorf("failed to get temperature: %w", err)
+	}
+
+	if temperature != "" {
+		t, err := strconv.ParseFloat(temperature, 64)
+		if err != nil {
+			return config, fmt.Errorf("failed to parse temperature: %w", err)
+		}
+		if t < 0 || t > 2 {
+			return config, fmt.Errorf("temperature must be between 0 and 2, got %g", t)
+		}
+		config.Temperature = &t
+	}
+
+	if config.PromptBudget, err = PromptBudget(ctx, repoPath); err != nil {
+		return config, err
+	}
+
+	if config.PromptFile, err = PromptFile(ctx, repoPath); err != nil {
+		return config, err
+	}
+
+	steps, err := ConfigGetWithDefault(ctx, repoPath, "toolSteps", uint32Converter(), 5)
+	if err != nil {
+		return config, fmt.Errorf("failed to get toolSteps: %w", err)
 	}
+	config.ToolSteps = int(steps)
 
-	return b
+	return config, nil
+}
+
+// IgnoreRules returns the pathspecs (from the multi-valued semblame.ignore key)
+// whose changes are left out of the text that gets embedded.
+func IgnoreRules(ctx context.Context, repoPath string) ([]string, error) {
+	rules, err := configGetAll(ctx, repoPath, "ignore")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ignore rules: %w", err)
+	}
+
+	return rules, nil
+}
+
+// NotesRemote returns the remote that semblame notes are pushed to and pulled
+// from.
+func NotesRemote(ctx context.Context, repoPath string) (string, error) {
+	r, err := ConfigGetWithDefaultString(ctx, repoPath, "remote", "origin")
+	if err != nil {
+		return "", fmt.Errorf("failed to get notes remote: %w", err)
+	}
+
+	return r, nil
 }
 
 // RepoUUID retrieves or generates and sets a UUID at the given git config key.
-func RepoUUID(ctx context.Context, repoPath string) uuid.UUID {
+// Under ReadConfig, a missing UUID is returned as uuid.Nil rather than
+// generated.
+func RepoUUID(ctx context.Context, repoPath string) (uuid.UUID, error) {
 	val, err := configGet(ctx, repoPath, "uuid")
 	if err != nil {
-		log.Fatalf("failed to get repo UUID: %v", err)
+		return uuid.Nil, fmt.Errorf("failed to get repo UUID: %w", err)
 	}
 
 	if val != "" {
 		id, err := uuid.Parse(val)
 		if err != nil {
-			log.Fatalf("failed to parse repo UUID: %v", err)
+			return uuid.Nil, fmt.Errorf("failed to parse repo UUID: %w", err)
 		}
-		return id
+		return id, nil
+	}
+
+	if readOnly(ctx) {
+		return uuid.Nil, nil
 	}
 
 	id, err := uuid.NewRandom()
 	if err != nil {
-		log.Fatalf("failed to create repo UUID: %v", err)
+		return uuid.Nil, fmt.Errorf("failed to create repo UUID: %w", err)
 	}
 
 	err = configSet(ctx, repoPath, "uuid", id.String())
 	if err != nil {
-		log.Fatalf("failed to set repo UUID: %v", err)
+		return uuid.Nil, fmt.Errorf("failed to set repo UUID: %w", err)
 	}
 
-	return id
+	return id, nil
+}
+
+// gitCommonDir returns the absolute path of the repository's common .git
+// directory (shared by all worktrees).
+func gitCommonDir(ctx context.Context, repoPath string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "rev-parse", "--path-format=absolute", "--git-common-dir")
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// DBPath returns the location of the repository's index database. In order of
+// precedence, it is taken from:
+//
+//   - the semblame.dbPath config key (relative paths are relative to repoPath),
+//   - .git/semblame/ if semblame.dbInGitDir is true, so that the index travels
+//     with the repository,
+//   - $SEMBLAME_HOME,
+//   - $XDG_DATA_HOME/semblame, with XDG_DATA_HOME defaulting to
+//     ~/.local/share.
+//
+// In all but the first case the file is named after the repository UUID, and
+// the path is empty if id is uuid.Nil, since no index can exist yet.
+func DBPath(ctx context.Context, repoPath string, id uuid.UUID) (string, error) {
+	path, err := configGet(ctx, repoPath, "dbPath")
+	if err != nil {
+		return "", fmt.Errorf("failed to get database path: %w", err)
+	}
+
+	if path != "" {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(repoPath, path)
+		}
+		return path, nil
+	}
+
+	if id == uuid.Nil {
+		return "", nil
+	}
+
+	fileName := id.String() + ".sqlite"
+
+	inGitDir, err := configGet(ctx, repoPath, "dbInGitDir")
+	if err != nil {
+		return "", fmt.Errorf("failed to get dbInGitDir: %w", err)
+	}
+
+	if inGitDir != "" {
+		b, err := strconv.ParseBool(inGitDir)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse dbInGitDir: %w", err)
+		}
+
+		if b {
+			gitDir, err := gitCommonDir(ctx, repoPath)
+			if err != nil {
+				return "", fmt.Errorf("failed to get git directory: %w", err)
+			}
+			return filepath.Join(gitDir, "semblame", fileName), nil
+		}
+	}
+
+	if home := os.Getenv("SEMBLAME_HOME"); home != "" {
+		return filepath.Join(home, fileName), nil
+	}
+
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		userHome, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get home directory: %w", err)
+		}
+		dataHome = filepath.Join(userHome, ".local", "share")
+	}
+
+	return filepath.Join(dataHome, "semblame", fileName), nil
 }
 
 type Config struct {
 	UUID       uuid.UUID
+	DBPath     string
 	Model      shared.EmbeddingModel
 	Dimensions uint32
 	RepoPath   string
 	WriteNotes bool
+	Ignore     []string
+	// LexicalWeight is the weight of the full-text ranking in hybrid retrieval.
+	LexicalWeight float64
+	// Chat holds the settings of the chat model.
+	Chat ChatConfig
 }
 
-func NewConfig(ctx context.Context, repoPath string) Config {
-	return Config{
-		UUID:       RepoUUID(ctx, repoPath),
-		Model:      shared.EmbeddingModelFromString(EmbeddingModel(ctx, repoPath)),
-		Dimensions: uint32(EmbeddingDimensions(ctx, repoPath)),
-		RepoPath:   repoPath,
-		WriteNotes: WriteNotes(ctx, repoPath),
+// NewConfig reads the semblame configuration of the repository at repoPath,
+// setting defaults for missing keys. It returns ErrNotARepository if repoPath
+// is not a Git repository.
+func NewConfig(ctx context.Context, repoPath string) (Config, error) {
+	if err := CheckRepository(ctx, repoPath); err != nil {
+		return Config{}, err
+	}
+
+	config := Config{RepoPath: repoPath}
+	var err error
+
+	if config.UUID, err = RepoUUID(ctx, repoPath); err != nil {
+		return Config{}, err
+	}
+	if config.DBPath, err = DBPath(ctx, repoPath, config.UUID); err != nil {
+		return Config{}, err
 	}
+	if config.Model, err = EmbeddingModel(ctx, repoPath); err != nil {
+		return Config{}, err
+	}
+	if config.Dimensions, err = EmbeddingDimensions(ctx, repoPath); err != nil {
+		return Config{}, err
+	}
+	if config.WriteNotes, err = WriteNotes(ctx, repoPath); err != nil {
+		return Config{}, err
+	}
+	if config.Ignore, err = IgnoreRules(ctx, repoPath); err != nil {
+		return Config{}, err
+	}
+	if config.LexicalWeight, err = LexicalWeight(ctx, repoPath); err != nil {
+		return Config{}, err
+	}
+	if config.Chat, err = Chat(ctx, repoPath); err != nil {
+		return Config{}, err
+	}
+
+	return config, nil
+}
+
+// ReadConfig is NewConfig without side effects: missing keys take their
+// defaults without being written to the Git config, and no UUID is generated
+// for a repository that has none, in which case DBPath is empty unless
+// semblame.dbPath is set.
+func ReadConfig(ctx context.Context, repoPath string) (Config, error) {
+	return NewConfig(context.WithValue(ctx, readOnlyKey{}, true), repoPath)
 }
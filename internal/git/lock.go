@@ -0,0 +1,43 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrLocked is returned by LockIngest when another process holds the lock.
+var ErrLocked = errors.New("another semblame ingest is running in this repository")
+
+// LockIngest takes an advisory lock on the repository, stored under the
+// common .git directory so that it is shared by all worktrees, and returns a
+// function releasing it. It fails with ErrLocked instead of waiting if the
+// lock is held. The lock is released by the OS if the process dies.
+func LockIngest(ctx context.Context, repoPath string) (func() error, error) {
+	gitDir, err := gitCommonDir(ctx, repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get git directory: %w", err)
+	}
+
+	dir := filepath.Join(gitDir, "semblame")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, "ingest.lock"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := tryLock(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() error {
+		unlock(f)
+		return f.Close()
+	}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package git
+
+import "os"
+
+// Advisory locking is only implemented on Unix; elsewhere concurrent ingests
+// rely on SQLite's own locking alone.
+
+func tryLock(f *os.File) error {
+	return nil
+}
+
+func unlock(f *os.File) {}
@@ -2,16 +2,81 @@ package git
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"fmt"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/vasilisp/semblame/internal/shared"
 )
 
-// GitLog runs 'git log -p' in the specified repository path and invokes the
-// provided handler for each complete log entry.
-func GitLog(ctx context.Context, repoPath string, entryHandler func(commitHash string, entry string) error) error {
-	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "log", "-p", "--reverse", "--no-notes")
+// entryArgs are the `git log` arguments producing the entries passed to the
+// GitLog handler. They override the configuration variables affecting the
+// output, so that an entry (and its fingerprint) depends only on the commit
+// and the ignore rules. --full-history and --sparse keep commits touching
+// only ignored paths, so that pathspecs filter the diffs but not the walk.
+var entryArgs = []string{
+	"-p", "--full-history", "--sparse", "--no-notes",
+	"--no-color", "--no-ext-diff", "--no-textconv", "--no-relative",
+	"--diff-algorithm=myers", "--no-renames", "--src-prefix=a/", "--dst-prefix=b/",
+	"--pretty=medium", "--date=default", "--no-decorate", "--no-abbrev-commit",
+	"--no-show-signature", "--no-mailmap",
+}
+
+// walkRevs are the revisions GitLog and LogCommitInfos walk the history
+// from: HEAD and every local branch.
+var walkRevs = []string{"HEAD", "--branches"}
+
+// ignorePathspecs returns the `git log` arguments excluding the given
+// pathspecs from the diffs of entryArgs.
+func ignorePathspecs(ignore []string) []string {
+	if len(ignore) == 0 {
+		return nil
+	}
+
+	args := []string{"--", "."}
+	for _, pathspec := range ignore {
+		args = append(args, ":(exclude)"+pathspec)
+	}
+
+	return args
+}
+
+// GitLog runs 'git log -p' in the specified repository path, from HEAD and
+// every local branch, and invokes the provided handler for each complete log
+// entry, oldest first. Paths matching any of the
+// ignore pathspecs are left out of the diffs; commits touching only such
+// paths are still visited, with an empty diff.
+func GitLog(ctx context.Context, repoPath string, ignore []string, entryHandler func(commitHash string, entry string) error) error {
+	args := append([]string{"-C", repoPath, "log", "--reverse"}, entryArgs...)
+	args = append(args, walkRevs...)
+	args = append(args, ignorePathspecs(ignore)...)
 
+	return scanEntries(exec.CommandContext(ctx, "git", args...), entryHandler)
+}
+
+// CommitEntries invokes entryHandler with the `git log -p` entry of each of
+// the given commits, as GitLog would.
+func CommitEntries(ctx context.Context, repoPath string, commitHashes []string, ignore []string, entryHandler func(commitHash string, entry string) error) error {
+	if len(commitHashes) == 0 {
+		return nil
+	}
+
+	args := append([]string{"-C", repoPath, "log", "--no-walk=unsorted", "--stdin"}, entryArgs...)
+	args = append(args, ignorePathspecs(ignore)...)
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Stdin = strings.NewReader(strings.Join(commitHashes, "\n") + "\n")
+
+	return scanEntries(cmd, entryHandler)
+}
+
+// scanEntries runs cmd, a `git log` with entryArgs, and invokes entryHandler
+// for each complete log entry.
+func scanEntries(cmd *exec.Cmd, entryHandler func(commitHash string, entry string) error) error {
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -53,6 +118,10 @@ func GitLog(ctx context.Context, repoPath string, entryHandler func(commitHash s
 	}
 
 	if builder.Len() > 0 && currentCommit != "" {
+		// git separates entries with a blank line, which the last one lacks;
+		// add it so that an entry does not change (and its fingerprint go
+		// stale) once a newer commit follows it
+		builder.WriteString("\n")
 		if err := entryHandler(currentCommit, builder.String()); err != nil {
 			return err
 		}
@@ -61,6 +130,17 @@ func GitLog(ctx context.Context, repoPath string, entryHandler func(commitHash s
 	return cmd.Wait()
 }
 
+// SplitEntry splits a `git log -p` entry into the header and message, and the
+// diff.
+func SplitEntry(entry string) (string, string) {
+	i := strings.Index(entry, "\ndiff --git ")
+	if i < 0 {
+		return entry, ""
+	}
+
+	return entry[:i+1], entry[i+1:]
+}
+
 // GetCommit returns the contents of a commit using `git show -p <commitHash>`.
 // It returns the output as a string, or an error if the command fails.
 func GetCommit(ctx context.Context, repoPath, commitHash string) (string, error) {
@@ -73,3 +153,279 @@ func GetCommit(ctx context.Context, repoPath, commitHash string) (string, error)
 
 	return string(out), nil
 }
+
+// CommitStat returns the header, message and diffstat of a commit using
+// `git show --stat <commitHash>`.
+func CommitStat(ctx context.Context, repoPath, commitHash string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "show", "--stat", commitHash)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+// CommitHeader returns the hash, author, date and subject of a commit, laid
+// out as in the header of `git show`.
+func CommitHeader(ctx context.Context, repoPath, commitHash string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "show", "-s", "--no-notes",
+		"--format=commit %H%nAuthor: %an <%ae>%nDate:   %ad%n%n    %s", commitHash)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+// commitInfoFormat is the `git log --format` producing the lines parsed by
+// parseCommitInfos.
+const commitInfoFormat = "--format=%H%x00%P%x00%an <%ae>%x00%at%x00%s"
+
+func parseCommitInfos(out []byte, infos map[string]shared.CommitInfo) error {
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.SplitN(line, "\x00", 5)
+		if len(fields) != 5 {
+			continue
+		}
+
+		timestamp, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return err
+		}
+
+		infos[fields[0]] = shared.CommitInfo{
+			Hash:    fields[0],
+			Parents: strings.Fields(fields[1]),
+			Author:  fields[2],
+			Date:    time.Unix(timestamp, 0),
+			Subject: fields[4],
+		}
+	}
+
+	return nil
+}
+
+// CommitInfos returns the metadata of the given commits, keyed by commit hash.
+// Commits missing from the repository (e.g. indexed from an archive or before
+// a rebase and since garbage collected) are left out. All commits are looked
+// up through a single `git log --no-walk --stdin`.
+func CommitInfos(ctx context.Context, repoPath string, commitHashes []string) (map[string]shared.CommitInfo, error) {
+	infos := make(map[string]shared.CommitInfo, len(commitHashes))
+
+	existing, err := ExistingCommits(ctx, repoPath, commitHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []string
+	for _, commitHash := range commitHashes {
+		if existing[commitHash] {
+			found = append(found, commitHash)
+		}
+	}
+
+	if len(found) == 0 {
+		return infos, nil
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "log", "--no-walk=unsorted", "--stdin", commitInfoFormat)
+	cmd.Stdin = strings.NewReader(strings.Join(found, "\n") + "\n")
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := parseCommitInfos(out, infos); err != nil {
+		return nil, err
+	}
+
+	return infos, nil
+}
+
+// ExistingCommits returns the subset of commitHashes naming commits in the
+// object store of the repository, as found by a single
+// `git cat-file --batch-check`.
+func ExistingCommits(ctx context.Context, repoPath string, commitHashes []string) (map[string]bool, error) {
+	existing := make(map[string]bool, len(commitHashes))
+	if len(commitHashes) == 0 {
+		return existing, nil
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "cat-file", "--batch-check=%(objecttype)")
+	cmd.Stdin = strings.NewReader(strings.Join(commitHashes, "\n") + "\n")
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// one output line per input line, in order: the object type, or the
+	// input followed by "missing"
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	if len(lines) != len(commitHashes) {
+		return nil, fmt.Errorf("unexpected git cat-file output: %d lines for %d commits", len(lines), len(commitHashes))
+	}
+
+	for i, line := range lines {
+		if line == "commit" {
+			existing[commitHashes[i]] = true
+		}
+	}
+
+	return existing, nil
+}
+
+// ReachableCommits returns the commits reachable from any ref or HEAD.
+func ReachableCommits(ctx context.Context, repoPath string) (map[string]bool, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "rev-list", "--all", "HEAD")
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list reachable commits: %w", err)
+	}
+
+	commits := make(map[string]bool)
+	for _, commitHash := range strings.Fields(string(out)) {
+		commits[commitHash] = true
+	}
+
+	return commits, nil
+}
+
+// LogCommitInfos returns the metadata of every commit GitLog visits, keyed by
+// commit hash.
+func LogCommitInfos(ctx context.Context, repoPath string) (map[string]shared.CommitInfo, error) {
+	args := append([]string{"-C", repoPath, "log", commitInfoFormat}, walkRevs...)
+
+	out, err := exec.CommandContext(ctx, "git", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make(map[string]shared.CommitInfo)
+	if err := parseCommitInfos(out, infos); err != nil {
+		return nil, err
+	}
+
+	return infos, nil
+}
+
+// Walked reports whether GitLog walks every commit reachable from rev, i.e.
+// whether HEAD or a local branch reaches rev.
+func Walked(ctx context.Context, repoPath, rev string) (bool, error) {
+	args := append([]string{"-C", repoPath, "rev-list", "-n", "1", rev, "--not"}, walkRevs...)
+	args = append(args, "--")
+
+	out, err := exec.CommandContext(ctx, "git", args...).Output()
+	if err != nil {
+		return false, fmt.Errorf("failed to list commits of %q: %w", rev, err)
+	}
+
+	return len(bytes.TrimSpace(out)) == 0, nil
+}
+
+// FilterCommits returns the hashes of the commits reachable from rev (HEAD if
+// empty) that touch a path matching the glob pattern, or all of them if path
+// is empty.
+func FilterCommits(ctx context.Context, repoPath, rev, path string) ([]string, error) {
+	if rev == "" {
+		rev = "HEAD"
+	}
+
+	args := []string{"-C", repoPath, "rev-list", rev, "--"}
+	if path != "" {
+		args = append(args, ":(glob)"+path)
+	}
+
+	out, err := exec.CommandContext(ctx, "git", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list commits of %q: %w", rev, err)
+	}
+
+	return strings.Fields(string(out)), nil
+}
+
+// ShowFile returns the contents of file at rev. It returns an error if the
+// file does not exist there.
+func ShowFile(ctx context.Context, repoPath, rev, file string) ([]byte, error) {
+	return exec.CommandContext(ctx, "git", "-C", repoPath, "show", rev+":"+file).Output()
+}
+
+// FuncHistory returns the commits that changed the function funcname in
+// file, oldest first, as tracked by `git log -L :funcname:file`. How the
+// function is delimited depends on the diff driver of the file (see
+// gitattributes(5)).
+func FuncHistory(ctx context.Context, repoPath, file, funcname string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "log", "--reverse", "--format=%H", "-s",
+		"-L", ":"+funcname+":"+file)
+
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("git log -L :%s:%s: %s", funcname, file, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+
+	return strings.Fields(string(out)), nil
+}
+
+// ResolveCommit returns the full hash of the commit rev refers to.
+func ResolveCommit(ctx context.Context, repoPath, rev string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("unknown revision %q", rev)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// CommitEntry returns the `git log -p` entry of a single commit, in the same
+// form GitLog passes to its handler. The commit is shown even if it touches
+// only ignored paths.
+func CommitEntry(ctx context.Context, repoPath, commitHash string, ignore []string) (string, error) {
+	args := append([]string{"-C", repoPath, "log", "--no-walk"}, entryArgs...)
+	args = append(args, commitHash)
+	args = append(args, ignorePathspecs(ignore)...)
+
+	out, err := exec.CommandContext(ctx, "git", args...).Output()
+	if err != nil {
+		return "", err
+	}
+
+	// GitLog ends every entry with the blank line git puts between them
+	return string(out) + "\n", nil
+}
+
+// Pickaxe returns the one-line summaries (hash, date, author, subject) of up
+// to n commits, newest first, that change the number of occurrences of text
+// (git log -S) or, if regexp is set, add or remove lines matching it (git log
+// -G). The search is limited to path if it is not empty.
+func Pickaxe(ctx context.Context, repoPath, text string, regexp bool, path string, n int) (string, error) {
+	option := "-S"
+	if regexp {
+		option = "-G"
+	}
+
+	args := []string{"-C", repoPath, "log", "--format=%H %ad %an %s", "--date=short", "-n", strconv.Itoa(n), option + text}
+	if path != "" {
+		args = append(args, "--", path)
+	}
+
+	out, err := exec.CommandContext(ctx, "git", args...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("git log %s: %s", option, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", err
+	}
+
+	return string(out), nil
+}
@@ -2,49 +2,282 @@ package git
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"os"
 	"os/exec"
-
-	"github.com/vasilisp/semblame/internal/util"
+	"strconv"
+	"strings"
 )
 
-// GetCommitNoteWithCallback streams the note attached to a given commit hash (if any) line by line,
-// calling the provided callback for each line. If no note is found, the callback is not called.
-// Returns an error if the command fails for other reasons.
-func GetCommitNoteWithCallback(ctx context.Context, repoPath, commitHash string, onLine func([]byte)) error {
-	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "notes", "show", commitHash)
+// notesRef is the notes ref semblame stores embeddings under. It is kept
+// apart from git's default notes ref, refs/notes/commits, so that the notes
+// people write by hand are neither read as embeddings nor shared along with
+// them.
+const notesRef = "refs/notes/semblame"
+
+// notesList returns the blob hash of every note under notesRef, keyed by the
+// annotated commit hash.
+func notesList(ctx context.Context, repoPath string) (map[string]string, error) {
+	blobs := make(map[string]string)
+
+	cmdVerify := exec.CommandContext(ctx, "git", "-C", repoPath, "rev-parse", "--verify", "-q", notesRef)
+	if err := cmdVerify.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			// no notes yet
+			return blobs, nil
+		}
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "notes", "--ref", notesRef, "list")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		blobs[fields[1]] = fields[0]
+	}
+
+	return blobs, nil
+}
+
+// NotedCommits returns the set of commits that have a semblame note, without
+// reading the notes.
+func NotedCommits(ctx context.Context, repoPath string) (map[string]bool, error) {
+	blobs, err := notesList(ctx, repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := make(map[string]bool, len(blobs))
+	for commitHash := range blobs {
+		commits[commitHash] = true
+	}
+
+	return commits, nil
+}
+
+// ReadNotes returns the contents of every semblame note in the repository,
+// keyed by commit hash. All notes are read through a single
+// `git cat-file --batch` process.
+func ReadNotes(ctx context.Context, repoPath string) (map[string][]byte, error) {
+	blobs, err := notesList(ctx, repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	notes := make(map[string][]byte, len(blobs))
+	if len(blobs) == 0 {
+		return notes, nil
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "cat-file", "--batch")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if err := cmd.Start(); err != nil {
-		return err
+		return nil, err
 	}
 
-	scanner := bufio.NewScanner(stdout)
-	found := false
-	for scanner.Scan() {
-		found = true
-		onLine(scanner.Bytes())
+	commits := make([]string, 0, len(blobs))
+	for commitHash := range blobs {
+		commits = append(commits, commitHash)
 	}
-	if err := scanner.Err(); err != nil {
-		return err
+
+	go func() {
+		w := bufio.NewWriter(stdin)
+		for _, commitHash := range commits {
+			fmt.Fprintln(w, blobs[commitHash])
+		}
+		w.Flush()
+		stdin.Close()
+	}()
+
+	reader := bufio.NewReader(stdout)
+	for _, commitHash := range commits {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			cmd.Process.Kill()
+			return nil, err
+		}
+
+		fields := strings.Fields(header)
+		if len(fields) != 3 || fields[1] != "blob" {
+			cmd.Process.Kill()
+			return nil, fmt.Errorf("unexpected cat-file output: %q", header)
+		}
+
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			cmd.Process.Kill()
+			return nil, err
+		}
+
+		// content is followed by a newline
+		content := make([]byte, size+1)
+		if _, err := io.ReadFull(reader, content); err != nil {
+			cmd.Process.Kill()
+			return nil, err
+		}
+
+		notes[commitHash] = content[:size]
 	}
 
 	if err := cmd.Wait(); err != nil {
-		// If the note does not exist, git notes show exits with status 1 and no output.
-		// We treat this as "no note" rather than an error.
-		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 && !found {
-			return nil
+		return nil, err
+	}
+
+	return notes, nil
+}
+
+// NoteLines splits the contents of a note into its non-empty lines.
+func NoteLines(note []byte) [][]byte {
+	var lines [][]byte
+	for _, line := range bytes.Split(note, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			lines = append(lines, line)
 		}
-		return err
 	}
+	return lines
+}
+
+// NotesWriter buffers note updates and writes all of them to the semblame
+// notes ref as a single commit on Flush.
+type NotesWriter struct {
+	repoPath string
+	commits  []string
+	notes    map[string]string
+}
+
+func NewNotesWriter(repoPath string) *NotesWriter {
+	return &NotesWriter{
+		repoPath: repoPath,
+		notes:    make(map[string]string),
+	}
+}
+
+// Set schedules note to replace the note attached to commitHash. Callers that
+// want to preserve other lines must merge them into note beforehand.
+func (w *NotesWriter) Set(commitHash, note string) error {
+	if note == "" {
+		return fmt.Errorf("empty note for commit %s", commitHash)
+	}
+
+	if _, ok := w.notes[commitHash]; !ok {
+		w.commits = append(w.commits, commitHash)
+	}
+	w.notes[commitHash] = note
+
 	return nil
 }
 
-func SetCommitNote(ctx context.Context, repoPath, commitHash, note string) error {
-	util.Assert(note != "", "note is empty")
+// Len returns the number of pending note updates.
+func (w *NotesWriter) Len() int {
+	return len(w.commits)
+}
+
+// Flush writes all pending notes through `git fast-import`, producing one
+// commit on the notes ref, and clears the pending set.
+func (w *NotesWriter) Flush(ctx context.Context) error {
+	if len(w.commits) == 0 {
+		return nil
+	}
 
-	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "notes", "add", "-f", "-m", note, commitHash)
+	ident, err := exec.CommandContext(ctx, "git", "-C", w.repoPath, "var", "GIT_COMMITTER_IDENT").Output()
+	if err != nil {
+		return fmt.Errorf("failed to get committer identity: %w", err)
+	}
+
+	var parent string
+	if out, err := exec.CommandContext(ctx, "git", "-C", w.repoPath, "rev-parse", "--verify", "-q", notesRef).Output(); err == nil {
+		parent = strings.TrimSpace(string(out))
+	}
+
+	var buf bytes.Buffer
+	message := fmt.Sprintf("Notes added by 'semblame ingest' (%d commits)\n", len(w.commits))
+
+	fmt.Fprintf(&buf, "commit %s\n", notesRef)
+	fmt.Fprintf(&buf, "committer %s\n", strings.TrimSpace(string(ident)))
+	fmt.Fprintf(&buf, "data %d\n%s\n", len(message), message)
+	if parent != "" {
+		fmt.Fprintf(&buf, "from %s\n", parent)
+	}
+	for _, commitHash := range w.commits {
+		note := w.notes[commitHash]
+		fmt.Fprintf(&buf, "N inline %s\n", commitHash)
+		fmt.Fprintf(&buf, "data %d\n%s\n", len(note), note)
+	}
+	buf.WriteString("done\n")
+
+	cmd := exec.CommandContext(ctx, "git", "-C", w.repoPath, "fast-import", "--quiet", "--done")
+	cmd.Stdin = &buf
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to write notes: %w", err)
+	}
+
+	w.commits = nil
+	w.notes = make(map[string]string)
+
+	return nil
+}
+
+// ConfigureNotesMerge sets the merge strategy for the semblame notes ref to
+// cat_sort_uniq, so that notes written concurrently on different machines
+// are combined line by line when fetched and merged.
+func ConfigureNotesMerge(ctx context.Context, repoPath string) error {
+	key := "notes." + strings.TrimPrefix(notesRef, "refs/notes/") + ".mergeStrategy"
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "config", key, "cat_sort_uniq")
+	return cmd.Run()
+}
+
+// remoteNotesRef returns the local ref under which notes fetched from remote
+// are kept before being merged into notesRef.
+func remoteNotesRef(remote string) string {
+	return "refs/notes/remotes/" + remote + "/" + strings.TrimPrefix(notesRef, "refs/notes/")
+}
+
+// PushNotes pushes the semblame notes ref to the given remote. Other notes
+// refs, refs/notes/commits included, are not pushed.
+func PushNotes(ctx context.Context, repoPath, remote string) error {
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "push", remote, notesRef+":"+notesRef)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
+
+// PullNotes fetches the semblame notes ref from the given remote and merges
+// it into the local notes ref using the cat_sort_uniq strategy, so that note
+// lines written on different machines are combined rather than overwritten.
+// Other notes refs are neither fetched nor merged.
+func PullNotes(ctx context.Context, repoPath, remote string) error {
+	if err := ConfigureNotesMerge(ctx, repoPath); err != nil {
+		return err
+	}
+
+	remoteRef := remoteNotesRef(remote)
+
+	cmdFetch := exec.CommandContext(ctx, "git", "-C", repoPath, "fetch", remote, "+"+notesRef+":"+remoteRef)
+	cmdFetch.Stdout = os.Stdout
+	cmdFetch.Stderr = os.Stderr
+	if err := cmdFetch.Run(); err != nil {
+		return err
+	}
+
+	cmdMerge := exec.CommandContext(ctx, "git", "-C", repoPath, "notes", "--ref", notesRef, "merge", "-q", "-s", "cat_sort_uniq", remoteRef)
+	cmdMerge.Stderr = os.Stderr
+	return cmdMerge.Run()
+}
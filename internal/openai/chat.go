@@ -0,0 +1,146 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"github.com/vasilisp/lingograph"
+	"github.com/vasilisp/lingograph/pkg/slicev"
+	"github.com/vasilisp/lingograph/store"
+)
+
+// Tool is a function the chat model may call before answering.
+type Tool struct {
+	Name        string
+	Description string
+	// Parameters is the JSON schema of the arguments.
+	Parameters map[string]any
+	// Call runs the tool with the arguments given by the model. Errors are
+	// reported to the model rather than ending the answer.
+	Call func(ctx context.Context, args json.RawMessage) (string, error)
+}
+
+// ChatConfig configures the actor returned by NewChatActor.
+type ChatConfig struct {
+	// Model is the name of the chat model.
+	Model string
+	// BaseURL is the URL of an OpenAI-compatible API, or empty for OpenAI.
+	BaseURL string
+	// Temperature is the sampling temperature, or nil for the model's
+	// default.
+	Temperature *float64
+	// Tools are the functions the model may call, at most MaxSteps times in
+	// a row before it has to answer.
+	Tools    []Tool
+	MaxSteps int
+}
+
+// rejectsTools reports whether err is a server refusing a request because it
+// offers tools, as OpenAI-compatible servers without tool support do.
+func rejectsTools(err error) bool {
+	var apiErr *openai.Error
+	return errors.As(err, &apiErr) &&
+		(apiErr.StatusCode == http.StatusBadRequest || apiErr.StatusCode == http.StatusUnprocessableEntity)
+}
+
+// callTool runs the tool called for by call and returns its output, or the
+// error for the model to see.
+func callTool(ctx context.Context, tools []Tool, call openai.ChatCompletionMessageToolCall) string {
+	for _, tool := range tools {
+		if tool.Name != call.Function.Name {
+			continue
+		}
+
+		out, err := tool.Call(ctx, json.RawMessage(call.Function.Arguments))
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return out
+	}
+
+	return "error: unknown tool " + call.Function.Name
+}
+
+// NewChatActor returns a lingograph actor answering with the chat model of
+// config, instructed by systemPrompt. The model may call config.Tools in
+// between; the calls and their results are not added to the chat history. If
+// the server rejects a request offering tools, it is sent again without them,
+// and tools are no longer offered.
+func NewChatActor(ctx context.Context, config ChatConfig, systemPrompt string) lingograph.Actor {
+	var opts []option.RequestOption
+	if config.BaseURL != "" {
+		opts = append(opts, option.WithBaseURL(config.BaseURL))
+	}
+	client := openai.NewClient(opts...)
+
+	toolParams := make([]openai.ChatCompletionToolParam, len(config.Tools))
+	for i, tool := range config.Tools {
+		toolParams[i] = openai.ChatCompletionToolParam{
+			Function: openai.FunctionDefinitionParam{
+				Name:        tool.Name,
+				Description: openai.String(tool.Description),
+				Parameters:  tool.Parameters,
+			},
+		}
+	}
+
+	return lingograph.NewActor(lingograph.Assistant, func(history slicev.RO[lingograph.Message], _ store.Store) (string, error) {
+		messages := make([]openai.ChatCompletionMessageParamUnion, 0, history.Len()+1)
+		messages = append(messages, openai.SystemMessage(systemPrompt))
+
+		it := history.Iterator()
+		for it.Next() {
+			msg := it.Value()
+			switch msg.Role {
+			case lingograph.Assistant:
+				messages = append(messages, openai.AssistantMessage(msg.Content))
+			default:
+				messages = append(messages, openai.UserMessage(msg.Content))
+			}
+		}
+
+		for step := 0; ; step++ {
+			params := openai.ChatCompletionNewParams{
+				Model:    config.Model,
+				Messages: messages,
+			}
+			if config.Temperature != nil {
+				params.Temperature = openai.Float(*config.Temperature)
+			}
+			// out of steps, the model has to answer with what it has
+			if step < config.MaxSteps && len(toolParams) > 0 {
+				params.Tools = toolParams
+			}
+
+			response, err := client.Chat.Completions.New(ctx, params)
+			if err != nil && len(params.Tools) > 0 && rejectsTools(err) {
+				// answer without tools, now and from then on
+				toolParams = nil
+				params.Tools = nil
+				response, err = client.Chat.Completions.New(ctx, params)
+			}
+			if err != nil {
+				return "", err
+			}
+
+			if len(response.Choices) == 0 {
+				return "", fmt.Errorf("no choices in response from %s", config.Model)
+			}
+
+			message := response.Choices[0].Message
+			if len(message.ToolCalls) == 0 || step >= config.MaxSteps {
+				return message.Content, nil
+			}
+
+			messages = append(messages, message.ToParam())
+			for _, call := range message.ToolCalls {
+				messages = append(messages, openai.ToolMessage(callTool(ctx, config.Tools, call), call.ID))
+			}
+		}
+	})
+}
@@ -1,17 +1,21 @@
 package openai
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"math"
+	"slices"
+	"strings"
 
 	"github.com/openai/openai-go"
 	"github.com/vasilisp/semblame/internal/shared"
-	"github.com/vasilisp/semblame/internal/util"
 )
 
 type EmbeddingClient interface {
@@ -25,8 +29,13 @@ type embeddingClient struct {
 	embeddingDimensions uint32
 }
 
-func NewEmbeddingClient(model shared.EmbeddingModel, embeddingDimensions uint32) EmbeddingClient {
-	util.Assert(embeddingDimensions > 0, "NewClient non-positive embeddingDimensions")
+// ErrEmptyInput is returned when asked to embed an empty string.
+var ErrEmptyInput = errors.New("empty embedding input")
+
+func NewEmbeddingClient(model shared.EmbeddingModel, embeddingDimensions uint32) (EmbeddingClient, error) {
+	if embeddingDimensions == 0 {
+		return nil, fmt.Errorf("%w: dimensions must be positive", shared.ErrInvalidDimensions)
+	}
 
 	client := openai.NewClient()
 
@@ -34,9 +43,16 @@ func NewEmbeddingClient(model shared.EmbeddingModel, embeddingDimensions uint32)
 		client:              &client,
 		model:               model,
 		embeddingDimensions: embeddingDimensions,
-	}
+	}, nil
 }
 
+// ChunkerVersion identifies how text is split into chunks before embedding.
+// Bump it whenever splitTextIntoChunks or chunkSize changes, so that
+// embeddings stored in notes are recognized as stale.
+const ChunkerVersion = "1"
+
+const chunkSize = 512
+
 func splitTextIntoChunks(text string, chunkSize int) *[]string {
 	var chunks []string
 	runes := []rune(text) // Handle multi-byte characters
@@ -53,9 +69,11 @@ func splitTextIntoChunks(text string, chunkSize int) *[]string {
 }
 
 func (c *embeddingClient) Embed(str string) ([]float64, error) {
-	util.Assert(str != "", "embed empty string")
+	if str == "" {
+		return nil, ErrEmptyInput
+	}
 
-	strings := *splitTextIntoChunks(str, 512)
+	strings := *splitTextIntoChunks(str, chunkSize)
 
 	embedding, err := c.client.Embeddings.New(context.TODO(), openai.EmbeddingNewParams{
 		Input:      openai.EmbeddingNewParamsInputUnion{OfArrayOfStrings: strings},
@@ -63,7 +81,7 @@ func (c *embeddingClient) Embed(str string) ([]float64, error) {
 		Dimensions: openai.Opt(int64(c.embeddingDimensions)),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create embedding: %v", err)
+		return nil, fmt.Errorf("failed to create embedding: %w", err)
 	}
 
 	if len(embedding.Data) == 0 {
@@ -71,6 +89,9 @@ func (c *embeddingClient) Embed(str string) ([]float64, error) {
 	}
 
 	vector := embedding.Data[0].Embedding
+	if uint32(len(vector)) != c.embeddingDimensions {
+		return nil, fmt.Errorf("%w: got %d dimensions, expected %d", shared.ErrDimensionMismatch, len(vector), c.embeddingDimensions)
+	}
 
 	return vector, nil
 }
@@ -104,21 +125,50 @@ func (t EmbeddingType) String() string {
 	case EmbeddingTypeFile:
 		return "file"
 	default:
-		log.Fatalf("invalid embedding type: %d", t)
-		return ""
+		return fmt.Sprintf("EmbeddingType(%d)", t)
+	}
+}
+
+// Fingerprint records the preprocessing an embedding was computed with. Two
+// embeddings of the same commit are interchangeable only if their
+// fingerprints are equal.
+type Fingerprint struct {
+	Chunker string `json:"chunker"`
+	Ignore  string `json:"ignore"`
+	Input   string `json:"input"`
+}
+
+func hashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewFingerprint computes the fingerprint of embedding input under the given
+// ignore rules and the current chunker.
+func NewFingerprint(ignore []string, input string) Fingerprint {
+	rules := slices.Clone(ignore)
+	slices.Sort(rules)
+
+	return Fingerprint{
+		Chunker: ChunkerVersion,
+		Ignore:  hashString(strings.Join(rules, "\n")),
+		Input:   hashString(input),
 	}
 }
 
 type EmbeddingJSON interface {
-	EmbeddingModel() shared.EmbeddingModel
+	EmbeddingModel() (shared.EmbeddingModel, error)
+	EmbeddingModelName() string
 	EmbeddingDimensions() uint32
 	EmbeddingVector() ([]float64, error)
 	EmbeddingFile() string
+	EmbeddingFingerprint() Fingerprint
 }
 
-func MakeEmbeddingJSON(typ EmbeddingType, model shared.EmbeddingModel, dimensions uint32, file string, vector []float64) EmbeddingJSON {
-	util.Assert(len(vector) > 0, "MakeEmbeddingJSON empty vector")
-	util.Assert(dimensions > 0, "MakeEmbeddingJSON non-positive dimensions")
+func MakeEmbeddingJSON(typ EmbeddingType, model shared.EmbeddingModel, dimensions uint32, file string, fingerprint Fingerprint, vector []float64) (EmbeddingJSON, error) {
+	if dimensions == 0 || uint32(len(vector)) != dimensions {
+		return nil, fmt.Errorf("%w: vector has %d dimensions, expected %d", shared.ErrDimensionMismatch, len(vector), dimensions)
+	}
 
 	bufVector := make([]byte, 8*len(vector))
 	for i, v := range vector {
@@ -127,12 +177,13 @@ func MakeEmbeddingJSON(typ EmbeddingType, model shared.EmbeddingModel, dimension
 	}
 
 	return &embeddingJSON{
-		Type:       typ.String(),
-		Model:      model.String(),
-		Dimensions: dimensions,
-		File:       file,
-		Vector:     base64.StdEncoding.EncodeToString(bufVector),
-	}
+		Type:        typ.String(),
+		Model:       model.String(),
+		Dimensions:  dimensions,
+		File:        file,
+		Vector:      base64.StdEncoding.EncodeToString(bufVector),
+		Fingerprint: fingerprint,
+	}, nil
 }
 
 type embeddingJSON struct {
@@ -141,6 +192,7 @@ type embeddingJSON struct {
 	Dimensions uint32 `json:"dimensions"`
 	File       string `json:"file"`
 	Vector     string `json:"vector"`
+	Fingerprint
 }
 
 func UnmarshalJSON(data []byte) (EmbeddingJSON, error) {
@@ -152,10 +204,61 @@ func UnmarshalJSON(data []byte) (EmbeddingJSON, error) {
 	return &emb, nil
 }
 
-func (e *embeddingJSON) EmbeddingModel() shared.EmbeddingModel {
+// sameSlot reports whether two note lines describe the same embedding, i.e.
+// share type, model, dimensions and file, so that one should replace the
+// other.
+func (e *embeddingJSON) sameSlot(other *embeddingJSON) bool {
+	return e.Type == other.Type &&
+		e.Model == other.Model &&
+		e.Dimensions == other.Dimensions &&
+		e.File == other.File
+}
+
+// MergeNote returns the note text obtained by adding emb to the existing note
+// lines. Lines for other (type, model, dimensions, file) tuples are kept as is;
+// lines for the same tuple are replaced by emb.
+func MergeNote(lines [][]byte, emb EmbeddingJSON) (string, error) {
+	e, ok := emb.(*embeddingJSON)
+	if !ok {
+		return "", fmt.Errorf("unexpected EmbeddingJSON implementation %T", emb)
+	}
+
+	var builder strings.Builder
+	for _, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var other embeddingJSON
+		if err := json.Unmarshal(line, &other); err == nil && e.sameSlot(&other) {
+			continue
+		}
+
+		builder.Write(line)
+		builder.WriteByte('\n')
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	builder.Write(line)
+	builder.WriteByte('\n')
+
+	return builder.String(), nil
+}
+
+func (e *embeddingJSON) EmbeddingModel() (shared.EmbeddingModel, error) {
 	return shared.EmbeddingModelFromString(e.Model)
 }
 
+// EmbeddingModelName returns the model name as recorded in the note, which
+// may refer to a model this version of semblame does not know about.
+func (e *embeddingJSON) EmbeddingModelName() string {
+	return e.Model
+}
+
 func (e *embeddingJSON) EmbeddingDimensions() uint32 {
 	return e.Dimensions
 }
@@ -178,3 +281,9 @@ func (e *embeddingJSON) EmbeddingVector() ([]float64, error) {
 func (e *embeddingJSON) EmbeddingFile() string {
 	return e.File
 }
+
+// EmbeddingFingerprint returns the preprocessing fingerprint recorded in the
+// note. Notes written before fingerprints were introduced have an empty one.
+func (e *embeddingJSON) EmbeddingFingerprint() Fingerprint {
+	return e.Fingerprint
+}
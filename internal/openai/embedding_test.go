@@ -0,0 +1,115 @@
+package openai
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/vasilisp/semblame/internal/shared"
+)
+
+func mustEmbeddingJSON(t *testing.T, model shared.EmbeddingModel, file string, vector ...float64) EmbeddingJSON {
+	t.Helper()
+
+	typ := EmbeddingTypeCommit
+	if file != "" {
+		typ = EmbeddingTypeFile
+	}
+
+	emb, err := MakeEmbeddingJSON(typ, model, uint32(len(vector)), file, NewFingerprint(nil, "input"), vector)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return emb
+}
+
+func noteLines(note string) [][]byte {
+	var lines [][]byte
+	for _, line := range strings.Split(note, "\n") {
+		if line != "" {
+			lines = append(lines, []byte(line))
+		}
+	}
+	return lines
+}
+
+func TestMergeNote(t *testing.T) {
+	small := mustEmbeddingJSON(t, shared.EmbeddingModel3Small, "", 1, 2)
+	large := mustEmbeddingJSON(t, shared.EmbeddingModel3Large, "", 3, 4)
+	file := mustEmbeddingJSON(t, shared.EmbeddingModel3Small, "main.go", 5, 6)
+
+	note, err := MergeNote(nil, small)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, emb := range []EmbeddingJSON{large, file} {
+		note, err = MergeNote(noteLines(note), emb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// replaces the line of the same model and dimensions only
+	updated := mustEmbeddingJSON(t, shared.EmbeddingModel3Small, "", 7, 8)
+	note, err = MergeNote(append([][]byte{[]byte("reviewed-by: someone")}, noteLines(note)...), updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := noteLines(note)
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want 4:\n%s", len(lines), note)
+	}
+
+	if string(lines[0]) != "reviewed-by: someone" {
+		t.Errorf("non-JSON line not kept first: %q", lines[0])
+	}
+
+	want := []struct {
+		model  string
+		file   string
+		vector []float64
+	}{
+		{"text-embedding-3-large", "", []float64{3, 4}},
+		{"text-embedding-3-small", "main.go", []float64{5, 6}},
+		{"text-embedding-3-small", "", []float64{7, 8}},
+	}
+
+	for i, w := range want {
+		emb, err := UnmarshalJSON(lines[i+1])
+		if err != nil {
+			t.Fatalf("line %d: %v", i+1, err)
+		}
+
+		vector, err := emb.EmbeddingVector()
+		if err != nil {
+			t.Fatalf("line %d: %v", i+1, err)
+		}
+
+		if emb.EmbeddingModelName() != w.model || emb.EmbeddingFile() != w.file || !slices.Equal(vector, w.vector) {
+			t.Errorf("line %d: got %s %q %v, want %s %q %v", i+1,
+				emb.EmbeddingModelName(), emb.EmbeddingFile(), vector, w.model, w.file, w.vector)
+		}
+	}
+}
+
+func TestMergeNoteDimensions(t *testing.T) {
+	short := mustEmbeddingJSON(t, shared.EmbeddingModel3Small, "", 1, 2)
+	long := mustEmbeddingJSON(t, shared.EmbeddingModel3Small, "", 1, 2, 3)
+
+	note, err := MergeNote(nil, short)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	note, err = MergeNote(noteLines(note), long)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := noteLines(note); len(lines) != 2 {
+		t.Errorf("got %d lines, want one per number of dimensions:\n%s", len(lines), note)
+	}
+}
@@ -1,12 +1,53 @@
 package shared
 
-import "log"
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+var (
+	// ErrUnknownModel is returned for embedding model names semblame does not
+	// support.
+	ErrUnknownModel = errors.New("unknown embedding model")
+	// ErrDimensionMismatch is returned when a vector, note or index does not
+	// have the configured number of dimensions.
+	ErrDimensionMismatch = errors.New("embedding dimension mismatch")
+	// ErrInvalidDimensions is returned when the configured number of
+	// dimensions is not a positive integer.
+	ErrInvalidDimensions = errors.New("invalid embedding dimensions")
+	// ErrModelMismatch is returned when an index or archive was built for a
+	// different embedding model than the configured one.
+	ErrModelMismatch = errors.New("embedding model mismatch")
+	// ErrSchemaTooNew is returned when opening a database created by a newer
+	// version of semblame.
+	ErrSchemaTooNew = errors.New("database schema is newer than supported")
+)
+
+// HashMention matches what may be a commit hash in text, abbreviated or not,
+// for both SHA-1 and SHA-256 repositories.
+var HashMention = regexp.MustCompile(`\b[0-9a-f]{7,64}\b`)
 
 type Match struct {
 	CommitHash string
 	Distance   float64
 }
 
+// CommitInfo holds the metadata of a single commit.
+type CommitInfo struct {
+	Hash    string
+	Parents []string
+	Author  string
+	Date    time.Time
+	Subject string
+}
+
+// Merge reports whether the commit is a merge commit.
+func (c *CommitInfo) Merge() bool {
+	return len(c.Parents) > 1
+}
+
 type EmbeddingModel uint8
 
 const (
@@ -24,21 +65,21 @@ func (m EmbeddingModel) String() string {
 	case EmbeddingModel3Large:
 		return "text-embedding-3-large"
 	default:
-		log.Fatalf("invalid embedding model: %d", m)
-		return ""
+		return fmt.Sprintf("EmbeddingModel(%d)", m)
 	}
 }
 
-func EmbeddingModelFromString(s string) EmbeddingModel {
+// EmbeddingModelFromString parses a model name, returning ErrUnknownModel
+// (wrapped) if it is not supported.
+func EmbeddingModelFromString(s string) (EmbeddingModel, error) {
 	switch s {
 	case "text-embedding-ada-002":
-		return EmbeddingModelAda002
+		return EmbeddingModelAda002, nil
 	case "text-embedding-3-small":
-		return EmbeddingModel3Small
+		return EmbeddingModel3Small, nil
 	case "text-embedding-3-large":
-		return EmbeddingModel3Large
+		return EmbeddingModel3Large, nil
 	default:
-		log.Fatalf("invalid embedding model: %s", s)
-		return EmbeddingModel3Large
+		return 0, fmt.Errorf("%w: %s", ErrUnknownModel, s)
 	}
 }
@@ -0,0 +1,201 @@
+package store
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+
+	"github.com/vasilisp/semblame/internal/shared"
+)
+
+type memoryEntry struct {
+	info      shared.CommitInfo
+	embedding []float64
+	norm      float64
+}
+
+// Memory is a VectorStore kept entirely in memory. Queries scan every
+// embedding, which is fast enough for one-off use and tests; it needs neither
+// cgo nor a file on disk.
+type Memory struct {
+	dimensions uint32
+	commits    map[string]memoryEntry
+	files      map[string][]float64
+}
+
+// NewMemory returns an empty in-memory store for embeddings of the given
+// dimensions.
+func NewMemory(dimensions uint32) *Memory {
+	return &Memory{
+		dimensions: dimensions,
+		commits:    make(map[string]memoryEntry),
+		files:      make(map[string][]float64),
+	}
+}
+
+func (m *Memory) checkDimensions(embedding []float64) error {
+	if len(embedding) != int(m.dimensions) {
+		return fmt.Errorf("%w: expected %d dimensions, got %d", shared.ErrDimensionMismatch, m.dimensions, len(embedding))
+	}
+	return nil
+}
+
+func norm(v []float64) float64 {
+	var sum float64
+	for _, x := range v {
+		sum += x * x
+	}
+	return math.Sqrt(sum)
+}
+
+// cosineDistance mirrors vec_distance_cosine.
+func cosineDistance(a []float64, aNorm float64, b []float64, bNorm float64) float64 {
+	if aNorm == 0 || bNorm == 0 {
+		return 1
+	}
+
+	var dot float64
+	for i := range a {
+		dot += a[i] * b[i]
+	}
+	return 1 - dot/(aNorm*bNorm)
+}
+
+func (m *Memory) Upsert(info shared.CommitInfo, embedding []float64) error {
+	if err := m.checkDimensions(embedding); err != nil {
+		return err
+	}
+
+	m.commits[info.Hash] = memoryEntry{
+		info:      info,
+		embedding: slices.Clone(embedding),
+		norm:      norm(embedding),
+	}
+
+	return nil
+}
+
+func (m *Memory) UpsertFile(filePath string, embedding []float64) error {
+	if err := m.checkDimensions(embedding); err != nil {
+		return err
+	}
+
+	m.files[filePath] = slices.Clone(embedding)
+	return nil
+}
+
+func (m *Memory) Delete(commitHash string) error {
+	delete(m.commits, commitHash)
+	return nil
+}
+
+func (m *Memory) Get(commitHash string) ([]float64, error) {
+	entry, ok := m.commits[commitHash]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, commitHash)
+	}
+
+	return slices.Clone(entry.embedding), nil
+}
+
+func (m *Memory) Query(embedding []float64, n int, filter Filter) ([]shared.Match, error) {
+	if err := m.checkDimensions(embedding); err != nil {
+		return nil, err
+	}
+
+	match, err := filter.Matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	queryNorm := norm(embedding)
+
+	var matches []shared.Match
+	for commitHash, entry := range m.commits {
+		if !match(entry.info) {
+			continue
+		}
+
+		distance := cosineDistance(embedding, queryNorm, entry.embedding, entry.norm)
+		if filter.MaxDistance > 0 && distance > filter.MaxDistance {
+			continue
+		}
+
+		matches = append(matches, shared.Match{CommitHash: commitHash, Distance: distance})
+	}
+
+	slices.SortFunc(matches, func(a, b shared.Match) int {
+		return cmp.Or(cmp.Compare(a.Distance, b.Distance), cmp.Compare(a.CommitHash, b.CommitHash))
+	})
+
+	return matches[:min(n, len(matches))], nil
+}
+
+func (m *Memory) Distances(embedding []float64, commitHashes []string) (map[string]float64, error) {
+	if err := m.checkDimensions(embedding); err != nil {
+		return nil, err
+	}
+
+	queryNorm := norm(embedding)
+
+	distances := make(map[string]float64, len(commitHashes))
+	for _, commitHash := range commitHashes {
+		if entry, ok := m.commits[commitHash]; ok {
+			distances[commitHash] = cosineDistance(embedding, queryNorm, entry.embedding, entry.norm)
+		}
+	}
+
+	return distances, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *Memory) ForEach(fn func(commitHash string, embedding []float64) error) error {
+	for _, commitHash := range sortedKeys(m.commits) {
+		if err := fn(commitHash, m.commits[commitHash].embedding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ForEachFile(fn func(filePath string, embedding []float64) error) error {
+	for _, filePath := range sortedKeys(m.files) {
+		if err := fn(filePath, m.files[filePath]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Stats() (Stats, error) {
+	stats := Stats{Commits: len(m.commits), Files: len(m.files)}
+
+	for _, entry := range m.commits {
+		date := entry.info.Date
+		if date.IsZero() {
+			continue
+		}
+		if stats.Oldest.IsZero() || date.Before(stats.Oldest) {
+			stats.Oldest = date
+		}
+		if date.After(stats.Newest) {
+			stats.Newest = date
+		}
+	}
+
+	return stats, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,141 @@
+// Package store defines the interface through which commit embeddings are
+// stored and searched, independently of the backend.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/vasilisp/semblame/internal/shared"
+)
+
+// ErrNotFound is returned when a commit is not in the store.
+var ErrNotFound = errors.New("commit not indexed")
+
+// Filter restricts the commits a query may return. The zero value matches
+// every commit.
+type Filter struct {
+	// Author, if set, is a regular expression matched case-insensitively
+	// against the commit author ("Name <email>"), as with git log --author.
+	Author string
+	// Since and Until, if set, bound the commit date (inclusive).
+	Since time.Time
+	Until time.Time
+	// ExcludeMerges leaves out commits with more than one parent.
+	ExcludeMerges bool
+	// Commits, if not nil, is the set of commits that may be returned, e.g.
+	// those reachable from a branch or touching a path.
+	Commits []string
+	// MaxDistance, if positive, is the largest cosine distance returned.
+	MaxDistance float64
+}
+
+// AuthorRegexp compiles the Author pattern, or returns nil if it is not set.
+func (f Filter) AuthorRegexp() (*regexp.Regexp, error) {
+	if f.Author == "" {
+		return nil, nil
+	}
+
+	re, err := regexp.Compile("(?i)" + f.Author)
+	if err != nil {
+		return nil, fmt.Errorf("invalid author pattern: %w", err)
+	}
+
+	return re, nil
+}
+
+// Matcher returns a function reporting whether a commit passes the filter.
+// MaxDistance is not checked, as it depends on the query.
+func (f Filter) Matcher() (func(info shared.CommitInfo) bool, error) {
+	author, err := f.AuthorRegexp()
+	if err != nil {
+		return nil, err
+	}
+
+	var commits map[string]bool
+	if f.Commits != nil {
+		commits = make(map[string]bool, len(f.Commits))
+		for _, commitHash := range f.Commits {
+			commits[commitHash] = true
+		}
+	}
+
+	return func(info shared.CommitInfo) bool {
+		if author != nil && !author.MatchString(info.Author) {
+			return false
+		}
+		if !f.Since.IsZero() && info.Date.Before(f.Since) {
+			return false
+		}
+		if !f.Until.IsZero() && info.Date.After(f.Until) {
+			return false
+		}
+		if f.ExcludeMerges && info.Merge() {
+			return false
+		}
+		if commits != nil && !commits[info.Hash] {
+			return false
+		}
+
+		return true
+	}, nil
+}
+
+// Stats summarizes the contents of a store.
+type Stats struct {
+	Commits int
+	Files   int
+	// Oldest and Newest are the earliest and latest commit dates, zero if
+	// the store is empty.
+	Oldest time.Time
+	Newest time.Time
+}
+
+// VectorStore holds one embedding per commit, along with the commit metadata
+// filters apply to, and answers nearest-neighbour queries by cosine distance.
+type VectorStore interface {
+	// Upsert inserts or replaces a commit and its embedding.
+	Upsert(info shared.CommitInfo, embedding []float64) error
+	// UpsertFile inserts or replaces the embedding of a file.
+	UpsertFile(filePath string, embedding []float64) error
+	// Delete removes a commit. Deleting a missing commit is not an error.
+	Delete(commitHash string) error
+	// Get returns the embedding of a commit, or ErrNotFound.
+	Get(commitHash string) ([]float64, error)
+	// Query returns the n commits passing filter that are nearest to
+	// embedding, nearest first.
+	Query(embedding []float64, n int, filter Filter) ([]shared.Match, error)
+	// Distances returns the distance between embedding and each of the given
+	// commits that is in the store.
+	Distances(embedding []float64, commitHashes []string) (map[string]float64, error)
+	// ForEach calls fn for every commit embedding, in commit hash order.
+	ForEach(fn func(commitHash string, embedding []float64) error) error
+	// ForEachFile calls fn for every file embedding, in path order.
+	ForEachFile(fn func(filePath string, embedding []float64) error) error
+	Stats() (Stats, error)
+	Close() error
+}
+
+// TextIndex is implemented by stores that also keep a full-text index of
+// commit messages and diffs.
+type TextIndex interface {
+	// HasTextIndex reports whether the index is usable.
+	HasTextIndex() (bool, error)
+	// IndexText adds or replaces the text of a commit already in the store.
+	IndexText(commitHash, message, diff string) error
+	// QueryText returns the hashes of up to n commits passing filter that
+	// match words of query, best first. filter.MaxDistance is ignored.
+	QueryText(query string, n int, filter Filter) ([]string, error)
+}
+
+// Batcher is implemented by stores that can group writes into transactions.
+// While a batch is open, writes become visible to readers only once it ends.
+type Batcher interface {
+	// BeginBatch starts a batch; writes until EndBatch go into it.
+	BeginBatch() error
+	// EndBatch commits the writes of the open batch, or discards them if
+	// commit is false. It does nothing if no batch is open.
+	EndBatch(commit bool) error
+}
@@ -0,0 +1,57 @@
+package semblame
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vasilisp/semblame/internal/blame"
+)
+
+// Conversation is a series of questions about a repository, each of which may
+// follow up on the earlier ones. Commits retrieved or cited for earlier
+// questions stay in the LLM's context.
+//
+// Conversations always use the configured chat model, whatever Explainer the
+// Repo was opened with.
+type Conversation struct {
+	repo    *Repo
+	session *blame.Session
+}
+
+// Converse starts a conversation about the repository.
+func (r *Repo) Converse(ctx context.Context) (*Conversation, error) {
+	session, err := blame.NewSession(ctx, r.config.RepoPath, r.blameOptions(blame.KindChat))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conversation{repo: r, session: session}, nil
+}
+
+// Ask retrieves the commits relevant to question, as Search does, adds those
+// not yet in the conversation, and asks it. The answer is streamed to the
+// Repo's stream.
+func (c *Conversation) Ask(ctx context.Context, question string, filters Filters) (*Explanation, error) {
+	matches, err := c.repo.Search(ctx, question, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := c.session.Ask(ctx, matches, question, c.repo.stream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to explain: %w", err)
+	}
+
+	return &Explanation{Answer: answer, Matches: matches, Citations: citations(answer, matches)}, nil
+}
+
+// Add puts the commit with the given hash into the conversation, so that
+// later questions can refer to it.
+func (c *Conversation) Add(ctx context.Context, commitHash string) error {
+	return c.session.Add(ctx, []Match{{CommitHash: commitHash}})
+}
+
+// Reset forgets the conversation so far.
+func (c *Conversation) Reset() {
+	c.session.Reset()
+}
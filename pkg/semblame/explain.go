@@ -0,0 +1,110 @@
+package semblame
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/vasilisp/semblame/internal/blame"
+	"github.com/vasilisp/semblame/internal/shared"
+)
+
+// Explanation is the answer to a query, along with the commits it is based
+// on.
+type Explanation struct {
+	Answer string
+	// Matches are the commits given to the LLM, in order.
+	Matches []Match
+	// Direct is the number of leading Matches that changed the explained
+	// code, as opposed to being retrieved for it. Their distance is zero
+	// when unknown.
+	Direct int
+	// Citations are the matched commits the answer refers to, in order of
+	// first mention.
+	Citations []Citation
+}
+
+// Citation is a commit referred to by an answer.
+type Citation struct {
+	CommitHash string
+	// Reason is the line of the answer that cites the commit, stripped of
+	// Markdown.
+	Reason string
+}
+
+var markdown = strings.NewReplacer("**", "", "__", "", "`", "")
+
+// citations returns the commits among matches that answer mentions by full or
+// abbreviated hash.
+func citations(answer string, matches []Match) []Citation {
+	var result []Citation
+	cited := make(map[string]bool)
+
+	for _, line := range strings.Split(answer, "\n") {
+		reason := strings.TrimSpace(markdown.Replace(line))
+		reason = strings.TrimSpace(strings.TrimLeft(reason, "-*+#>"))
+
+		for _, mention := range shared.HashMention.FindAllString(line, -1) {
+			for _, match := range matches {
+				if strings.HasPrefix(match.CommitHash, mention) && !cited[match.CommitHash] {
+					cited[match.CommitHash] = true
+					result = append(result, Citation{CommitHash: match.CommitHash, Reason: reason})
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+// blameOptions returns the options of the chat model for questions of the
+// given kind. The model's semantic searches go through Search, unfiltered.
+func (r *Repo) blameOptions(kind string) blame.Options {
+	return blame.Options{
+		Config: r.config.Chat,
+		Prompt: blame.Prompt{Kind: kind, Style: r.style},
+		Search: func(ctx context.Context, query string, n int) ([]Match, error) {
+			return r.Search(ctx, query, Filters{Limit: n})
+		},
+	}
+}
+
+// explain asks the Explainer, or else the configured chat model with the
+// system prompt for kind, to answer question from matches, the first direct of
+// which changed the code in question.
+func (r *Repo) explain(ctx context.Context, kind, question string, matches []Match, direct int) (*Explanation, error) {
+	var answer string
+	var err error
+	if r.explainer != nil {
+		answer, err = r.explainer.Explain(ctx, r.config.RepoPath, matches, question, r.stream)
+	} else {
+		answer, err = blame.Blame(ctx, r.config.RepoPath, r.blameOptions(kind), matches, question, r.stream)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to explain: %w", err)
+	}
+
+	return &Explanation{
+		Answer:    answer,
+		Matches:   matches,
+		Direct:    direct,
+		Citations: citations(answer, matches),
+	}, nil
+}
+
+// Explain retrieves the commits relevant to query, as Search does, and asks
+// the configured Explainer to answer it from them.
+func (r *Repo) Explain(ctx context.Context, query string, filters Filters) (*Explanation, error) {
+	matches, err := r.Search(ctx, query, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.ExplainMatches(ctx, query, matches)
+}
+
+// ExplainMatches asks the configured Explainer to answer query from the given
+// commits, e.g. ones already retrieved with Search.
+func (r *Repo) ExplainMatches(ctx context.Context, query string, matches []Match) (*Explanation, error) {
+	return r.explain(ctx, blame.KindQuery, query, matches, 0)
+}
@@ -0,0 +1,338 @@
+package semblame
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vasilisp/semblame/internal/git"
+	"github.com/vasilisp/semblame/internal/openai"
+	"github.com/vasilisp/semblame/internal/shared"
+	"github.com/vasilisp/semblame/internal/store"
+)
+
+// IngestOptions configures Ingest.
+type IngestOptions struct {
+	// NoNotes disables writing new embeddings to Git notes, regardless of
+	// semblame.write-notes.
+	NoNotes bool
+	// NotesOnly indexes only the commits with a usable embedding in their
+	// notes, so that no embedding requests are made.
+	NotesOnly bool
+}
+
+// IngestStats summarizes an Ingest run.
+type IngestStats struct {
+	// Commits is the number of commits indexed.
+	Commits int
+	// Skipped is the number of commits left out because of NotesOnly.
+	Skipped int
+	// Embedded is the number of commits that had to be embedded, because no
+	// usable embedding was found in their notes.
+	Embedded int
+	// Refreshed is the number of embedded commits whose note embedding was
+	// stale.
+	Refreshed int
+	// Pruned is the number of commits removed from the store because no ref
+	// reaches them any more, e.g. after a rebase.
+	Pruned int
+}
+
+// ingestNote parses the note lines attached to a commit and returns the commit
+// and file embeddings matching the configured model and dimensions. Lines
+// that are not embeddings are skipped, as MergeNote keeps them. A commit
+// embedding whose fingerprint differs from the given one is not returned; the
+// stale result reports whether such an embedding was found.
+func ingestNote(config *git.Config, lines [][]byte, fingerprint openai.Fingerprint) ([]float64, map[string][]float64, bool, error) {
+	var commitEmbedding []float64
+	fileEmbeddings := make(map[string][]float64)
+	stale := false
+
+	for _, line := range lines {
+		embeddingJSON, err := openai.UnmarshalJSON(line)
+		if err != nil {
+			continue
+		}
+
+		if embeddingJSON.EmbeddingModelName() != config.Model.String() || embeddingJSON.EmbeddingDimensions() != config.Dimensions {
+			continue
+		}
+
+		// file embeddings are not produced by ingest, so we have no input to
+		// check them against
+		if embeddingJSON.EmbeddingFile() == "" && embeddingJSON.EmbeddingFingerprint() != fingerprint {
+			stale = true
+			continue
+		}
+
+		embedding, err := embeddingJSON.EmbeddingVector()
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("failed to get embedding vector: %w", err)
+		}
+
+		if embeddingJSON.EmbeddingFile() != "" {
+			fileEmbeddings[embeddingJSON.EmbeddingFile()] = embedding
+		} else {
+			commitEmbedding = embedding
+			stale = false
+		}
+	}
+
+	return commitEmbedding, fileEmbeddings, stale, nil
+}
+
+// ingestBatchSize is the number of commits written to the store per
+// transaction.
+const ingestBatchSize = 100
+
+// indexedCommit is a commit waiting to be written to the store.
+type indexedCommit struct {
+	info           shared.CommitInfo
+	embedding      []float64
+	message, diff  string
+	fileEmbeddings map[string][]float64
+}
+
+// inBatch calls fn, in a single transaction if the store supports it.
+func (r *Repo) inBatch(fn func() error) error {
+	batcher, batched := r.store.(store.Batcher)
+	if batched {
+		if err := batcher.BeginBatch(); err != nil {
+			return err
+		}
+	}
+
+	err := fn()
+
+	if batched {
+		if errEnd := batcher.EndBatch(err == nil); errEnd != nil && err == nil {
+			err = errEnd
+		}
+	}
+
+	return err
+}
+
+// writeBatch writes commits to the store, in a single transaction if the
+// store supports it. Embedding requests are made before, so that the write
+// lock is not held while waiting for them.
+func (r *Repo) writeBatch(commits []indexedCommit) error {
+	if len(commits) == 0 {
+		return nil
+	}
+
+	return r.inBatch(func() error {
+		return r.writeCommits(commits)
+	})
+}
+
+func (r *Repo) writeCommits(commits []indexedCommit) error {
+	textIndex, hasText := r.store.(TextIndex)
+
+	for _, commit := range commits {
+		if err := r.store.Upsert(commit.info, commit.embedding); err != nil {
+			return err
+		}
+
+		if hasText {
+			if err := textIndex.IndexText(commit.info.Hash, commit.message, commit.diff); err != nil {
+				return err
+			}
+		}
+
+		for filePath, fileEmbedding := range commit.fileEmbeddings {
+			if err := r.store.UpsertFile(filePath, fileEmbedding); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// prune deletes the commits in the store that no ref reaches any more, and
+// returns how many there were. Commits that only a tag, a remote-tracking
+// branch or a stash reaches are kept, although Ingest does not walk them.
+func (r *Repo) prune(ctx context.Context) (int, error) {
+	reachable, err := git.ReachableCommits(ctx, r.config.RepoPath)
+	if err != nil {
+		return 0, err
+	}
+
+	var unreachable []string
+	err = r.store.ForEach(func(commitHash string, _ []float64) error {
+		if !reachable[commitHash] {
+			unreachable = append(unreachable, commitHash)
+		}
+		return nil
+	})
+	if err != nil || len(unreachable) == 0 {
+		return 0, err
+	}
+
+	err = r.inBatch(func() error {
+		for _, commitHash := range unreachable {
+			if err := r.store.Delete(commitHash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune commits: %w", err)
+	}
+
+	return len(unreachable), nil
+}
+
+// checkTextIndex warns if lexical retrieval is configured but the store has
+// no full-text index.
+func (r *Repo) checkTextIndex() error {
+	textIndex, ok := r.store.(TextIndex)
+	if !ok || r.config.LexicalWeight == 0 {
+		return nil
+	}
+
+	hasLexical, err := textIndex.HasTextIndex()
+	if err != nil {
+		return fmt.Errorf("failed to check lexical index: %w", err)
+	}
+
+	if !hasLexical {
+		fmt.Fprintln(r.warnings, "warning: lexical search unavailable: the store has no full-text index; set semblame.lexicalWeight to 0")
+	}
+
+	return nil
+}
+
+// Ingest walks the repository history and indexes every commit. Embeddings
+// found in Git notes are reused; the rest are computed and, unless disabled,
+// written back to notes. Commits are written to the store in batches, and
+// only one Ingest may run in a repository at a time; others fail with
+// ErrLocked. Once the walk succeeds, commits that no ref reaches any more are
+// pruned from the store. A warning is reported if lexical retrieval is
+// configured but the store has no full-text index.
+func (r *Repo) Ingest(ctx context.Context, opts IngestOptions) (IngestStats, error) {
+	var stats IngestStats
+
+	repoPath := r.config.RepoPath
+	writeNotes := r.config.WriteNotes && !opts.NoNotes
+
+	unlock, err := git.LockIngest(ctx, repoPath)
+	if err != nil {
+		return stats, err
+	}
+	defer unlock()
+
+	if writeNotes {
+		if err := git.ConfigureNotesMerge(ctx, repoPath); err != nil {
+			return stats, err
+		}
+	}
+
+	if err := r.checkTextIndex(); err != nil {
+		return stats, err
+	}
+
+	notes, err := git.ReadNotes(ctx, repoPath)
+	if err != nil {
+		return stats, err
+	}
+
+	infos, err := git.LogCommitInfos(ctx, repoPath)
+	if err != nil {
+		return stats, err
+	}
+
+	notesWriter := git.NewNotesWriter(repoPath)
+	var batch []indexedCommit
+
+	err = git.GitLog(ctx, repoPath, r.config.Ignore, func(commitHash string, entry string) error {
+		noteLines := git.NoteLines(notes[commitHash])
+		fingerprint := openai.NewFingerprint(r.config.Ignore, entry)
+
+		embedding, fileEmbeddings, stale, err := ingestNote(&r.config, noteLines, fingerprint)
+		if err != nil {
+			return err
+		}
+
+		if embedding == nil && opts.NotesOnly {
+			stats.Skipped++
+			return nil
+		}
+
+		if embedding == nil {
+			if stale {
+				stats.Refreshed++
+			}
+
+			embedding, err = r.embedder.Embed(entry)
+			if err != nil {
+				return err
+			}
+			stats.Embedded++
+
+			if writeNotes {
+				embeddingJSON, err := openai.MakeEmbeddingJSON(openai.EmbeddingTypeCommit, r.config.Model, r.config.Dimensions, "", fingerprint, embedding)
+				if err != nil {
+					return err
+				}
+
+				note, err := openai.MergeNote(noteLines, embeddingJSON)
+				if err != nil {
+					return err
+				}
+
+				if err := notesWriter.Set(commitHash, note); err != nil {
+					return err
+				}
+			}
+		}
+
+		info, ok := infos[commitHash]
+		if !ok {
+			info = shared.CommitInfo{Hash: commitHash}
+		}
+
+		message, diff := git.SplitEntry(entry)
+		batch = append(batch, indexedCommit{
+			info:           info,
+			embedding:      embedding,
+			message:        message,
+			diff:           diff,
+			fileEmbeddings: fileEmbeddings,
+		})
+
+		if len(batch) < ingestBatchSize {
+			return nil
+		}
+
+		err = r.writeBatch(batch)
+		if err == nil {
+			stats.Commits += len(batch)
+		}
+		batch = batch[:0]
+
+		return err
+	})
+
+	// write whatever we embedded, even if the walk failed midway
+	if errWrite := r.writeBatch(batch); errWrite != nil {
+		if err == nil {
+			err = errWrite
+		}
+	} else {
+		stats.Commits += len(batch)
+	}
+
+	if errFlush := notesWriter.Flush(ctx); errFlush != nil {
+		return stats, fmt.Errorf("failed to write notes: %w", errFlush)
+	}
+
+	if err != nil {
+		return stats, err
+	}
+
+	stats.Pruned, err = r.prune(ctx)
+
+	return stats, err
+}
@@ -0,0 +1,108 @@
+package semblame
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/vasilisp/semblame/internal/git"
+	"github.com/vasilisp/semblame/internal/openai"
+	"github.com/vasilisp/semblame/internal/shared"
+)
+
+func noteLine(t *testing.T, model shared.EmbeddingModel, file string, fingerprint openai.Fingerprint, vector ...float64) []byte {
+	t.Helper()
+
+	typ := openai.EmbeddingTypeCommit
+	if file != "" {
+		typ = openai.EmbeddingTypeFile
+	}
+
+	emb, err := openai.MakeEmbeddingJSON(typ, model, uint32(len(vector)), file, fingerprint, vector)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	note, err := openai.MergeNote(nil, emb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []byte(strings.TrimSpace(note))
+}
+
+func TestIngestNote(t *testing.T) {
+	config := &git.Config{Model: shared.EmbeddingModel3Small, Dimensions: 2}
+	fingerprint := openai.NewFingerprint(nil, "entry")
+	stale := openai.NewFingerprint(nil, "amended entry")
+
+	tests := []struct {
+		name      string
+		lines     [][]byte
+		embedding []float64
+		files     int
+		stale     bool
+	}{
+		{
+			name:  "empty",
+			lines: nil,
+		},
+		{
+			name: "matching",
+			lines: [][]byte{
+				noteLine(t, shared.EmbeddingModel3Small, "", fingerprint, 1, 2),
+			},
+			embedding: []float64{1, 2},
+		},
+		{
+			name: "other model and dimensions",
+			lines: [][]byte{
+				noteLine(t, shared.EmbeddingModel3Large, "", fingerprint, 1, 2),
+				noteLine(t, shared.EmbeddingModel3Small, "", fingerprint, 1, 2, 3),
+			},
+		},
+		{
+			name: "stale",
+			lines: [][]byte{
+				noteLine(t, shared.EmbeddingModel3Small, "", stale, 1, 2),
+			},
+			stale: true,
+		},
+		{
+			name: "human lines",
+			lines: [][]byte{
+				[]byte("Reviewed-by: someone"),
+				[]byte("{not json"),
+				noteLine(t, shared.EmbeddingModel3Small, "", fingerprint, 3, 4),
+			},
+			embedding: []float64{3, 4},
+		},
+		{
+			name: "file embeddings",
+			lines: [][]byte{
+				noteLine(t, shared.EmbeddingModel3Small, "a.go", stale, 5, 6),
+				noteLine(t, shared.EmbeddingModel3Small, "b.go", stale, 7, 8),
+			},
+			files: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			embedding, files, isStale, err := ingestNote(config, tt.lines, fingerprint)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(embedding, tt.embedding) {
+				t.Errorf("embedding: got %v, want %v", embedding, tt.embedding)
+			}
+			if len(files) != tt.files {
+				t.Errorf("file embeddings: got %d, want %d", len(files), tt.files)
+			}
+			if isStale != tt.stale {
+				t.Errorf("stale: got %t, want %t", isStale, tt.stale)
+			}
+		})
+	}
+}
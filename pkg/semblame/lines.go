@@ -0,0 +1,107 @@
+package semblame
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/vasilisp/semblame/internal/blame"
+	"github.com/vasilisp/semblame/internal/git"
+)
+
+// LineRange is a 1-based, inclusive range of lines in a file, relative to
+// the repository root.
+type LineRange = git.LineRange
+
+// ParseLineRange parses "<file>:<line>" or "<file>:<start>-<end>".
+func ParseLineRange(s string) (LineRange, error) {
+	return git.ParseLineRange(s)
+}
+
+// lineHistoryDepth bounds how far back ExplainLines follows the history of
+// the lines.
+const lineHistoryDepth = 10
+
+// relatedLimit is the default number of semantically related commits
+// ExplainLines adds to the ones that touched the lines.
+const relatedLimit = 5
+
+const linesQuestion = `Why do lines %s look the way they do?
+
+` + "```" + `
+%s
+` + "```" + `
+
+The first %d commits above changed these lines: first those that last touched them, then earlier ones that changed the same region, most recent first. Cite them first. The remaining commits are semantically related; cite them only where they add context.`
+
+// ExplainLines asks the LLM why the given lines look the way they do. The
+// commits that last touched them (per git blame, ignoring whitespace and
+// following moves and copies) and earlier commits that changed the same
+// region (per git log -L) come first in the explanation's matches; up to
+// filters.Limit (5 if zero) semantically related commits passing filters
+// follow.
+func (r *Repo) ExplainLines(ctx context.Context, lines LineRange, filters Filters) (*Explanation, error) {
+	repoPath := r.config.RepoPath
+
+	blamed, err := git.Blame(ctx, repoPath, lines)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := git.LineHistory(ctx, repoPath, lines, lineHistoryDepth)
+	if err != nil {
+		return nil, err
+	}
+
+	direct := blamed.Commits
+	for _, commitHash := range history {
+		if !slices.Contains(direct, commitHash) {
+			direct = append(direct, commitHash)
+		}
+	}
+
+	code := strings.Join(blamed.Lines, "\n")
+
+	embedding, err := r.embedder.Embed(lines.File + "\n" + code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed lines: %w", err)
+	}
+
+	distances, err := r.store.Distances(embedding, direct)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]Match, 0, len(direct))
+	for _, commitHash := range direct {
+		matches = append(matches, Match{CommitHash: commitHash, Distance: distances[commitHash]})
+	}
+
+	n := filters.Limit
+	if n <= 0 {
+		n = relatedLimit
+	}
+	filters.Limit = n + len(direct)
+
+	related, err := r.search(ctx, code, embedding, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	added := 0
+	for _, match := range related {
+		if added == n {
+			break
+		}
+		if slices.Contains(direct, match.CommitHash) {
+			continue
+		}
+		matches = append(matches, match)
+		added++
+	}
+
+	question := fmt.Sprintf(linesQuestion, lines, code, len(direct))
+
+	return r.explain(ctx, blame.KindLines, question, matches, len(direct))
+}
@@ -0,0 +1,208 @@
+package semblame
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/vasilisp/semblame/internal/git"
+	"github.com/vasilisp/semblame/internal/store"
+)
+
+// rrfK dampens the advantage of top ranks in reciprocal rank fusion; 60 is
+// the customary value.
+const rrfK = 60
+
+// candidatePool is the number of candidates each ranking contributes before
+// fusion.
+const candidatePool = 50
+
+// fuseRankings combines a semantic and a lexical ranking of commit hashes by
+// weighted reciprocal rank fusion and returns the hashes best first.
+// lexicalWeight is the weight of the lexical ranking; the semantic one gets
+// the remainder.
+func fuseRankings(semantic []string, lexical []string, lexicalWeight float64) []string {
+	scores := make(map[string]float64)
+	var hashes []string
+
+	add := func(ranking []string, weight float64) {
+		for rank, commitHash := range ranking {
+			if _, ok := scores[commitHash]; !ok {
+				hashes = append(hashes, commitHash)
+			}
+			scores[commitHash] += weight / float64(rrfK+rank+1)
+		}
+	}
+
+	add(semantic, 1-lexicalWeight)
+	add(lexical, lexicalWeight)
+
+	slices.SortStableFunc(hashes, func(a, b string) int {
+		switch {
+		case scores[a] > scores[b]:
+			return -1
+		case scores[a] < scores[b]:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	return hashes
+}
+
+// DefaultLimit is the number of matches Search returns when Filters.Limit is
+// not set.
+const DefaultLimit = 10
+
+// Filters restricts the commits Search may return. Filters are applied
+// during retrieval, so up to Limit matches are returned however selective
+// they are.
+type Filters struct {
+	// Limit is the maximum number of matches; DefaultLimit if zero.
+	Limit int
+	// Author is a regular expression matched case-insensitively against
+	// "Name <email>", as with git log --author.
+	Author string
+	// Since and Until bound the commit date (inclusive) if set.
+	Since time.Time
+	Until time.Time
+	// Path restricts matches to commits touching a path matching the glob
+	// pattern (see gitglossary(7), pathspec "glob" magic).
+	Path string
+	// Branch restricts matches to commits reachable from the given revision,
+	// which HEAD or a local branch must reach (see ErrBranchNotIngested).
+	Branch string
+	// ExcludeMerges leaves out merge commits.
+	ExcludeMerges bool
+	// MaxDistance, if positive, drops matches farther than this cosine
+	// distance from the query.
+	MaxDistance float64
+}
+
+// ErrBranchNotIngested is returned when filtering on a branch that neither
+// HEAD nor any local branch reaches, since Ingest only walks those.
+var ErrBranchNotIngested = errors.New("branch not ingested")
+
+// storeFilter resolves filters into a store.Filter, listing the commits
+// allowed by Path and Branch through git.
+func (r *Repo) storeFilter(ctx context.Context, filters Filters) (store.Filter, error) {
+	filter := store.Filter{
+		Author:        filters.Author,
+		Since:         filters.Since,
+		Until:         filters.Until,
+		ExcludeMerges: filters.ExcludeMerges,
+		MaxDistance:   filters.MaxDistance,
+	}
+
+	if filters.Branch != "" {
+		walked, err := git.Walked(ctx, r.config.RepoPath, filters.Branch)
+		if err != nil {
+			return filter, err
+		}
+		if !walked {
+			return filter, fmt.Errorf("%w: %s is not reachable from HEAD or a local branch", ErrBranchNotIngested, filters.Branch)
+		}
+	}
+
+	if filters.Path != "" || filters.Branch != "" {
+		commits, err := git.FilterCommits(ctx, r.config.RepoPath, filters.Branch, filters.Path)
+		if err != nil {
+			return filter, err
+		}
+
+		// non-nil even if empty, so that nothing matches
+		filter.Commits = append([]string{}, commits...)
+	}
+
+	return filter, nil
+}
+
+// Search retrieves the commits most relevant to query, fusing the nearest
+// neighbours of its embedding with full-text matches on commit messages and
+// diffs. Lexical matches are skipped if the store has no full-text index.
+func (r *Repo) Search(ctx context.Context, query string, filters Filters) ([]Match, error) {
+	embedding, err := r.embedder.Embed(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed query: %w", err)
+	}
+
+	return r.search(ctx, query, embedding, filters)
+}
+
+// search is Search with the query already embedded.
+func (r *Repo) search(ctx context.Context, query string, embedding []float64, filters Filters) ([]Match, error) {
+	n := filters.Limit
+	if n <= 0 {
+		n = DefaultLimit
+	}
+
+	filter, err := r.storeFilter(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	semanticMatches, err := r.store.Query(embedding, max(n, candidatePool), filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var lexical []string
+	if textIndex, ok := r.store.(TextIndex); ok && r.config.LexicalWeight > 0 {
+		hasLexical, err := textIndex.HasTextIndex()
+		if err != nil {
+			return nil, fmt.Errorf("failed to check lexical index: %w", err)
+		}
+
+		// Ingest warns about a missing full-text index
+		if hasLexical {
+			lexical, err = textIndex.QueryText(query, max(n, candidatePool), filter)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	semantic := make([]string, len(semanticMatches))
+	distances := make(map[string]float64, len(semanticMatches))
+	for i, match := range semanticMatches {
+		semantic[i] = match.CommitHash
+		distances[match.CommitHash] = match.Distance
+	}
+
+	fused := fuseRankings(semantic, lexical, r.config.LexicalWeight)
+
+	var missing []string
+	for _, commitHash := range fused {
+		if _, ok := distances[commitHash]; !ok {
+			missing = append(missing, commitHash)
+		}
+	}
+
+	extra, err := r.store.Distances(embedding, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Match
+	for _, commitHash := range fused {
+		distance, ok := distances[commitHash]
+		if !ok {
+			distance = extra[commitHash]
+		}
+
+		// lexical matches have not been held to the distance bound yet
+		if filters.MaxDistance > 0 && distance > filters.MaxDistance {
+			continue
+		}
+
+		results = append(results, Match{CommitHash: commitHash, Distance: distance})
+		if len(results) == n {
+			break
+		}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,53 @@
+package semblame
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFuseRankings(t *testing.T) {
+	tests := []struct {
+		name          string
+		semantic      []string
+		lexical       []string
+		lexicalWeight float64
+		want          []string
+	}{
+		{
+			name:          "semantic only",
+			semantic:      []string{"a", "b", "c"},
+			lexicalWeight: 0.5,
+			want:          []string{"a", "b", "c"},
+		},
+		{
+			name:          "weight 0 keeps the semantic order",
+			semantic:      []string{"a", "b", "c"},
+			lexical:       []string{"c", "b", "d"},
+			lexicalWeight: 0,
+			want:          []string{"a", "b", "c", "d"},
+		},
+		{
+			name:          "weight 1 follows the lexical order",
+			semantic:      []string{"a", "b", "c"},
+			lexical:       []string{"c", "b", "d"},
+			lexicalWeight: 1,
+			want:          []string{"c", "b", "d", "a"},
+		},
+		{
+			name:          "found by both ranks first",
+			semantic:      []string{"a", "b", "c"},
+			lexical:       []string{"d", "e", "c"},
+			lexicalWeight: 0.5,
+			want:          []string{"c", "a", "d", "b", "e"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fuseRankings(tt.semantic, tt.lexical, tt.lexicalWeight)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
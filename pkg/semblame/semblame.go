@@ -0,0 +1,259 @@
+// Package semblame is the public API for indexing a Git repository's history
+// with embeddings, searching it, and asking an LLM to explain the results.
+//
+// A typical session:
+//
+//	repo, err := semblame.Open(ctx, "path/to/repo")
+//	if err != nil {
+//		return err
+//	}
+//	defer repo.Close()
+//
+//	if _, err := repo.Ingest(ctx, semblame.IngestOptions{}); err != nil {
+//		return err
+//	}
+//
+//	explanation, err := repo.Explain(ctx, "why do we retry uploads?", semblame.Filters{})
+package semblame
+
+import (
+	"context"
+	"io"
+
+	"github.com/vasilisp/semblame/internal/blame"
+	"github.com/vasilisp/semblame/internal/git"
+	"github.com/vasilisp/semblame/internal/openai"
+	"github.com/vasilisp/semblame/internal/shared"
+	"github.com/vasilisp/semblame/internal/store"
+)
+
+// Match is a commit retrieved for a query, along with the cosine distance
+// between their embeddings.
+type Match = shared.Match
+
+// VectorStore stores commit embeddings and answers nearest-neighbour queries.
+// Stores that also implement TextIndex take part in full-text retrieval.
+type VectorStore = store.VectorStore
+
+// TextIndex is implemented by stores with a full-text index of commits.
+type TextIndex = store.TextIndex
+
+// CommitInfo is the metadata of a commit stored along with its embedding.
+type CommitInfo = shared.CommitInfo
+
+// Filter is the form of Filters passed to VectorStore queries, with the
+// branch and path filters resolved to a set of commits.
+type Filter = store.Filter
+
+// Stats summarizes the contents of a VectorStore.
+type Stats = store.Stats
+
+// ErrNotIndexed is returned by VectorStore.Get for commits not in the store.
+var ErrNotIndexed = store.ErrNotFound
+
+var (
+	// ErrNotARepository is returned by Open if the path is not in a Git
+	// repository.
+	ErrNotARepository = git.ErrNotARepository
+	// ErrUnknownModel is returned by Open for an unsupported semblame.model.
+	ErrUnknownModel = shared.ErrUnknownModel
+	// ErrDimensionMismatch is returned when an embedding, note or index does
+	// not have the configured number of dimensions.
+	ErrDimensionMismatch = shared.ErrDimensionMismatch
+	// ErrInvalidDimensions is returned by Open if semblame.dimensions is not
+	// a positive integer.
+	ErrInvalidDimensions = shared.ErrInvalidDimensions
+	// ErrModelMismatch is returned by Open if the index was built for another
+	// embedding model; see WithRebuild.
+	ErrModelMismatch = shared.ErrModelMismatch
+	// ErrSchemaTooNew is returned by Open if the index was created by a newer
+	// version of semblame.
+	ErrSchemaTooNew = shared.ErrSchemaTooNew
+	// ErrLocked is returned by Ingest, and by Open with WithRebuild, while
+	// another ingest runs in the repository.
+	ErrLocked = git.ErrLocked
+	// ErrNoAPIKey is returned when asking the configured chat model a
+	// question without OPENAI_API_KEY set (and no semblame.chatBaseURL).
+	ErrNoAPIKey = blame.ErrNoAPIKey
+)
+
+// ErrUnknownStyle is returned by Open when WithStyle is given an answer style
+// that does not exist.
+var ErrUnknownStyle = blame.ErrUnknownStyle
+
+// NewMemoryStore returns an empty VectorStore kept in memory, for embeddings
+// of the given dimensions. It works without cgo; populate it with Ingest,
+// typically with IngestOptions.NotesOnly.
+func NewMemoryStore(dimensions uint32) VectorStore {
+	return store.NewMemory(dimensions)
+}
+
+// Embedder turns text into an embedding vector. Its dimensions must match the
+// repository's semblame.dimensions setting.
+type Embedder interface {
+	Embed(text string) ([]float64, error)
+}
+
+// Explainer answers a query given the commits retrieved for it. The answer is
+// written to w as it is produced, and returned.
+type Explainer interface {
+	Explain(ctx context.Context, repoPath string, matches []Match, query string, w io.Writer) (string, error)
+}
+
+// ExplainerFunc adapts a function to the Explainer interface.
+type ExplainerFunc func(ctx context.Context, repoPath string, matches []Match, query string, w io.Writer) (string, error)
+
+func (f ExplainerFunc) Explain(ctx context.Context, repoPath string, matches []Match, query string, w io.Writer) (string, error) {
+	return f(ctx, repoPath, matches, query, w)
+}
+
+// Repo is an open semblame index of a Git repository. It is not safe for
+// concurrent use.
+type Repo struct {
+	config   git.Config
+	store    VectorStore
+	embedder Embedder
+	// explainer is nil for the configured chat model
+	explainer Explainer
+	style     string
+	stream    io.Writer
+	warnings  io.Writer
+	rebuild   bool
+}
+
+// Option configures a Repo.
+type Option func(*Repo)
+
+// WithEmbedder replaces the OpenAI embedding client, which is otherwise
+// created for the configured model and dimensions.
+func WithEmbedder(embedder Embedder) Option {
+	return func(r *Repo) {
+		r.embedder = embedder
+	}
+}
+
+// WithStore replaces the SQLite index database with the given store. The
+// store must hold embeddings of the configured model and dimensions; Close
+// closes it.
+func WithStore(store VectorStore) Option {
+	return func(r *Repo) {
+		r.store = store
+	}
+}
+
+// WithDBPath overrides the location of the SQLite index database, which is
+// otherwise derived from the repository configuration.
+func WithDBPath(path string) Option {
+	return func(r *Repo) {
+		r.config.DBPath = path
+	}
+}
+
+// WithRebuild empties the SQLite index database and sets it up for the
+// configured model and dimensions before opening it, so that it can be
+// ingested again after either changed. It has no effect with WithStore.
+func WithRebuild() Option {
+	return func(r *Repo) {
+		r.rebuild = true
+	}
+}
+
+// WithChatModel overrides the configured chat model (semblame.chatModel) of
+// the default Explainer and of conversations. An empty model leaves the
+// configured one.
+func WithChatModel(model string) Option {
+	return func(r *Repo) {
+		if model != "" {
+			r.config.Chat.Model = model
+		}
+	}
+}
+
+// WithStyle selects the structure of answers from the configured chat model:
+// "summary", "detailed" (the default) or "timeline". Open returns
+// ErrUnknownStyle for any other. It has no effect on Explainers given with
+// WithExplainer.
+func WithStyle(style string) Option {
+	return func(r *Repo) {
+		r.style = style
+	}
+}
+
+// WithExplainer replaces the LLM used by Explain.
+func WithExplainer(explainer Explainer) Option {
+	return func(r *Repo) {
+		r.explainer = explainer
+	}
+}
+
+// WithStream makes Explain write the answer to w as it is produced. By
+// default it is only returned.
+func WithStream(w io.Writer) Option {
+	return func(r *Repo) {
+		r.stream = w
+	}
+}
+
+// WithWarnings sets where non-fatal problems (e.g. a missing full-text index)
+// are reported. By default they are discarded.
+func WithWarnings(w io.Writer) Option {
+	return func(r *Repo) {
+		r.warnings = w
+	}
+}
+
+// Open reads the semblame configuration of the repository at repoPath and
+// opens its index, creating it if needed. The index is a SQLite database
+// unless WithStore is given; binaries built without cgo must give one. Open
+// returns ErrNotARepository if repoPath is not a Git repository, and
+// ErrUnknownStyle if WithStyle is given an unknown style.
+func Open(ctx context.Context, repoPath string, opts ...Option) (*Repo, error) {
+	config, err := git.NewConfig(ctx, repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Repo{
+		config:   config,
+		stream:   io.Discard,
+		warnings: io.Discard,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if err := blame.CheckStyle(r.style); err != nil {
+		return nil, err
+	}
+
+	if r.embedder == nil {
+		r.embedder, err = openai.NewEmbeddingClient(r.config.Model, r.config.Dimensions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if r.store == nil {
+		r.store, err = openSQLiteStore(ctx, r.config, r.rebuild)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Close closes the index.
+func (r *Repo) Close() error {
+	return r.store.Close()
+}
+
+// Store returns the store backing the index.
+func (r *Repo) Store() VectorStore {
+	return r.store
+}
+
+// Path returns the path of the repository.
+func (r *Repo) Path() string {
+	return r.config.RepoPath
+}
@@ -0,0 +1,61 @@
+package semblame
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/vasilisp/semblame/internal/git"
+)
+
+// Similar retrieves the indexed commits nearest to the commit rev refers to,
+// leaving out that commit. Its stored embedding is used if it is indexed;
+// otherwise it is embedded on the fly. Matches are restricted by filters as
+// with Search.
+func (r *Repo) Similar(ctx context.Context, rev string, filters Filters) ([]Match, error) {
+	n := filters.Limit
+	if n <= 0 {
+		n = DefaultLimit
+	}
+
+	commitHash, err := git.ResolveCommit(ctx, r.config.RepoPath, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	embedding, err := r.store.Get(commitHash)
+	if errors.Is(err, ErrNotIndexed) {
+		entry, err := git.CommitEntry(ctx, r.config.RepoPath, commitHash, r.config.Ignore)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read commit: %w", err)
+		}
+
+		embedding, err = r.embedder.Embed(entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to embed commit: %w", err)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	filter, err := r.storeFilter(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	// the commit itself is its own nearest neighbour
+	matches, err := r.store.Query(embedding, n+1, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Match
+	for _, match := range matches {
+		if match.CommitHash == commitHash || len(results) == n {
+			continue
+		}
+		results = append(results, match)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,27 @@
+//go:build cgo
+
+package semblame
+
+import (
+	"context"
+
+	"github.com/vasilisp/semblame/internal/db"
+	"github.com/vasilisp/semblame/internal/git"
+)
+
+func openSQLiteStore(ctx context.Context, config git.Config, rebuild bool) (VectorStore, error) {
+	if rebuild {
+		unlock, err := git.LockIngest(ctx, config.RepoPath)
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.Rebuild(ctx, config.DBPath, config.Model, config.Dimensions)
+		unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return db.OpenStore(ctx, config.DBPath, config.Model, config.Dimensions)
+}
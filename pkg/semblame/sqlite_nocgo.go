@@ -0,0 +1,18 @@
+//go:build !cgo
+
+package semblame
+
+import (
+	"context"
+	"errors"
+
+	"github.com/vasilisp/semblame/internal/git"
+)
+
+// ErrNoSQLite is returned by Open when no store is given to a binary built
+// without cgo, which the SQLite store requires.
+var ErrNoSQLite = errors.New("SQLite store unavailable without cgo; use WithStore")
+
+func openSQLiteStore(ctx context.Context, config git.Config, rebuild bool) (VectorStore, error) {
+	return nil, ErrNoSQLite
+}
@@ -0,0 +1,211 @@
+package semblame
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/vasilisp/semblame/internal/blame"
+	"github.com/vasilisp/semblame/internal/git"
+)
+
+// symbolHistoryLimit bounds the number of commits ExplainSymbol narrates; the
+// most recent ones are kept.
+const symbolHistoryLimit = 20
+
+// symbolCandidateLimit bounds the number of commits git log -L proposes for a
+// Go symbol, each of which is checked by parsing the file before and after
+// it.
+const symbolCandidateLimit = 2 * symbolHistoryLimit
+
+// ErrSymbolNotFound is returned by ExplainSymbol when the symbol does not
+// exist at HEAD or no commit touched it.
+var ErrSymbolNotFound = errors.New("symbol not found")
+
+const symbolQuestion = `Tell the story of how %s in %s evolved. The commits above changed it, oldest first. Go through them in chronological order and, for each, explain what changed and why.`
+
+// receiverName returns the name of the type a method is declared on.
+func receiverName(recv *ast.FieldList) string {
+	if recv == nil || len(recv.List) == 0 {
+		return ""
+	}
+
+	expr := recv.List[0].Type
+	for {
+		switch e := expr.(type) {
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.IndexExpr:
+			expr = e.X
+		case *ast.IndexListExpr:
+			expr = e.X
+		case *ast.Ident:
+			return e.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// goSymbol is the source, doc comment included, of a symbol in a Go file,
+// along with the lines (1-based, inclusive) it spans.
+type goSymbol struct {
+	source     string
+	start, end int
+}
+
+// findGoSymbol locates the function, method ("Type.Method") or type called
+// name in the Go file src. It returns false if there is no such symbol, and
+// an error if the file does not parse.
+func findGoSymbol(src []byte, name string) (goSymbol, bool, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return goSymbol{}, false, err
+	}
+
+	recv, name, isMethod := strings.Cut(name, ".")
+	if !isMethod {
+		name, recv = recv, ""
+	}
+
+	symbol := func(node ast.Node, doc *ast.CommentGroup) (goSymbol, bool, error) {
+		start := fset.Position(node.Pos())
+		if doc != nil {
+			start = fset.Position(doc.Pos())
+		}
+		end := fset.Position(node.End())
+
+		return goSymbol{
+			source: string(src[start.Offset:end.Offset]),
+			start:  start.Line,
+			end:    end.Line,
+		}, true, nil
+	}
+
+	for _, decl := range file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Name.Name == name && receiverName(d.Recv) == recv {
+				return symbol(d, d.Doc)
+			}
+		case *ast.GenDecl:
+			if d.Tok != token.TYPE || isMethod {
+				continue
+			}
+			for _, spec := range d.Specs {
+				if spec := spec.(*ast.TypeSpec); spec.Name.Name == name {
+					if len(d.Specs) == 1 {
+						return symbol(d, d.Doc)
+					}
+					return symbol(spec, spec.Doc)
+				}
+			}
+		}
+	}
+
+	return goSymbol{}, false, nil
+}
+
+// goSymbolSource returns the source of the named symbol in file at rev, or
+// the empty string if the file or the symbol does not exist there. It returns
+// false if the file does not parse, so that the source cannot be told.
+func goSymbolSource(ctx context.Context, repoPath, rev, file, name string) (string, bool) {
+	src, err := git.ShowFile(ctx, repoPath, rev, file)
+	if err != nil {
+		return "", true
+	}
+
+	symbol, _, err := findGoSymbol(src, name)
+	if err != nil {
+		return "", false
+	}
+
+	return symbol.source, true
+}
+
+// goSymbolHistory returns up to symbolHistoryLimit commits that changed the
+// source of the named symbol in a Go file, oldest first. The symbol is located
+// in HEAD with go/parser, and git log -L follows its lines back through
+// history; a candidate commit is dropped only if the symbol parses to the same
+// source before and after it.
+func goSymbolHistory(ctx context.Context, repoPath, file, name string) ([]string, error) {
+	src, err := git.ShowFile(ctx, repoPath, "HEAD", file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s does not exist at HEAD", ErrSymbolNotFound, file)
+	}
+
+	symbol, found, err := findGoSymbol(src, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s at HEAD: %w", file, err)
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %s in %s at HEAD", ErrSymbolNotFound, name, file)
+	}
+
+	candidates, err := git.LineHistory(ctx, repoPath, git.LineRange{File: file, Start: symbol.start, End: symbol.end}, symbolCandidateLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []string
+	for _, commitHash := range candidates {
+		after, okAfter := goSymbolSource(ctx, repoPath, commitHash, file, name)
+		before, okBefore := goSymbolSource(ctx, repoPath, commitHash+"^", file, name)
+
+		// a revision that does not parse cannot tell; trust git log -L
+		if okAfter && okBefore && after == before {
+			continue
+		}
+
+		commits = append(commits, commitHash)
+		if len(commits) == symbolHistoryLimit {
+			break
+		}
+	}
+
+	slices.Reverse(commits)
+
+	return commits, nil
+}
+
+// ExplainSymbol asks the LLM for a chronological account of how a symbol in
+// file evolved and why. In Go files, symbol is a function, a method
+// ("Type.Method") or a type, located with go/parser and followed with
+// git log -L; elsewhere it is a function name passed to git log -L. All
+// matches of the explanation are Direct.
+func (r *Repo) ExplainSymbol(ctx context.Context, file, symbol string) (*Explanation, error) {
+	repoPath := r.config.RepoPath
+
+	var commits []string
+	var err error
+	if path.Ext(file) == ".go" {
+		commits, err = goSymbolHistory(ctx, repoPath, file, symbol)
+	} else {
+		commits, err = git.FuncHistory(ctx, repoPath, file, symbol)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(commits) == 0 {
+		return nil, fmt.Errorf("%w: %s in %s", ErrSymbolNotFound, symbol, file)
+	}
+
+	commits = commits[max(0, len(commits)-symbolHistoryLimit):]
+
+	matches := make([]Match, len(commits))
+	for i, commitHash := range commits {
+		matches[i] = Match{CommitHash: commitHash}
+	}
+
+	question := fmt.Sprintf(symbolQuestion, symbol, file)
+
+	return r.explain(ctx, blame.KindSymbol, question, matches, len(matches))
+}